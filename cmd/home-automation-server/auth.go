@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookieName    = "ha_session"
+	sessionSweepInterval = time.Minute
+)
+
+type session struct {
+	user      string
+	csrfToken string
+	expires   time.Time
+}
+
+type sessionContextKey struct{}
+
+// dummyPasswordHash is compared against for unknown users, so a failed login
+// takes as long whether or not the user exists.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+func authEnabled(config *Config) bool {
+	return len(config.Auth.Users) > 0
+}
+
+func (config *Config) findUser(name string) (User, bool) {
+	for _, user := range config.Auth.Users {
+		if user.Name == name {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+func newToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Fatalf("Failed to generate random token: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// printPasswordHash reads a password from stdin and prints its bcrypt hash
+// for use in <auth><user passwordHash="..."/></auth>.
+func printPasswordHash() error {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return fmt.Errorf("failed to read password: %v", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+// valid reports whether the session is still live. Sessions end when they
+// expire or the user is removed from config.
+func (s *session) valid(config *Config, now time.Time) bool {
+	_, userExists := config.findUser(s.user)
+	return userExists && !now.After(s.expires)
+}
+
+func (app *App) createSession(user string) (string, *session) {
+	app.expireSessions()
+
+	config := app.getConfig()
+	timeout := time.Duration(config.Auth.SessionTimeout) * time.Minute
+
+	app.sessionMutex.Lock()
+	defer app.sessionMutex.Unlock()
+
+	s := &session{
+		user:      user,
+		csrfToken: newToken(),
+		expires:   time.Now().Add(timeout),
+	}
+	token := newToken()
+	app.sessions[token] = s
+	return token, s
+}
+
+// findSession returns the live session for token, ending it if it is no
+// longer valid.
+func (app *App) findSession(config *Config, token string) *session {
+	app.sessionMutex.Lock()
+	s, exists := app.sessions[token]
+	valid := exists && s.valid(config, time.Now())
+	if exists && !valid {
+		delete(app.sessions, token)
+	}
+	app.sessionMutex.Unlock()
+
+	if exists && !valid {
+		app.closeSessionClients(token)
+	}
+	if !valid {
+		return nil
+	}
+	return s
+}
+
+func (app *App) getSession(r *http.Request) (string, *session) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", nil
+	}
+
+	config := app.getConfig()
+	s := app.findSession(&config, cookie.Value)
+	if s == nil {
+		return "", nil
+	}
+
+	app.sessionMutex.Lock()
+	s.expires = time.Now().Add(time.Duration(config.Auth.SessionTimeout) * time.Minute)
+	app.sessionMutex.Unlock()
+	return cookie.Value, s
+}
+
+// expireSessions ends sessions that are no longer valid and disconnects
+// their WebSocket clients.
+func (app *App) expireSessions() {
+	config := app.getConfig()
+	now := time.Now()
+
+	var expired []string
+	app.sessionMutex.Lock()
+	for token, s := range app.sessions {
+		if !s.valid(&config, now) {
+			delete(app.sessions, token)
+			expired = append(expired, token)
+		}
+	}
+	app.sessionMutex.Unlock()
+
+	for _, token := range expired {
+		app.closeSessionClients(token)
+	}
+}
+
+// startSessionExpiry ends sessions as they expire, so WebSocket clients do
+// not outlive their session.
+func (app *App) startSessionExpiry() {
+	ticker := time.NewTicker(sessionSweepInterval)
+	go func() {
+		for range ticker.C {
+			app.expireSessions()
+		}
+	}()
+}
+
+// setSessionCookie sets the session cookie to expire with the session, so
+// the browser keeps it as long as the sliding session lasts.
+func setSessionCookie(w http.ResponseWriter, config *Config, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   config.Auth.SessionTimeout * 60,
+		HttpOnly: true,
+		Secure:   config.Auth.SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func sessionFromRequest(r *http.Request) *session {
+	s, _ := r.Context().Value(sessionContextKey{}).(*session)
+	return s
+}
+
+// requireAuth wraps a handler so it is only reachable with a valid session
+// when users are configured. State-changing requests must also carry the
+// session's CSRF token in the X-CSRF-Token header.
+func (app *App) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := app.getConfig()
+		if !authEnabled(&config) {
+			next(w, r)
+			return
+		}
+
+		token, s := app.getSession(r)
+		if s == nil {
+			if strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/ws" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			} else {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+			}
+			return
+		}
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			token := r.Header.Get("X-CSRF-Token")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.csrfToken)) != 1 {
+				log.Printf("Rejected %s %s from %s: invalid CSRF token", r.Method, r.URL.Path, s.user)
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+
+		// getSession extended the session; extend the cookie to match
+		setSessionCookie(w, &config, token)
+		next(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, s)))
+	}
+}
+
+// checkOrigin allows WebSocket upgrades from the dashboard's own host and any
+// explicitly configured origins. Clients that send no Origin (non-browser
+// tools) are allowed; they still need a session when auth is enabled.
+func (app *App) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range strings.Split(app.getConfig().Auth.AllowedOrigins, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	log.Printf("Rejected WebSocket connection from origin %s", origin)
+	return false
+}
+
+func (app *App) handleLogin(w http.ResponseWriter, r *http.Request) {
+	config := app.getConfig()
+	if !authEnabled(&config) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	data := struct {
+		Title string
+		Error string
+	}{
+		Title: "Home Automation Control",
+	}
+
+	if r.Method == "POST" {
+		name := r.FormValue("username")
+		password := r.FormValue("password")
+
+		user, exists := config.findUser(name)
+		hash := []byte(user.PasswordHash)
+		if !exists {
+			hash = dummyPasswordHash
+		}
+		if bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && exists {
+			token, _ := app.createSession(user.Name)
+			setSessionCookie(w, &config, token)
+			log.Printf("User %s logged in from %s", user.Name, r.RemoteAddr)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		log.Printf("Failed login for '%s' from %s", name, r.RemoteAddr)
+		data.Error = "Invalid username or password"
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	app.configMutex.RLock()
+	templates := app.templates
+	app.configMutex.RUnlock()
+
+	if err := templates.ExecuteTemplate(w, "login.html", data); err != nil {
+		log.Printf("Template execution error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// handleLogout ends the session. It is wrapped in requireAuth, so a logout
+// must carry the session's CSRF token.
+func (app *App) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if token, s := app.getSession(r); s != nil {
+		app.sessionMutex.Lock()
+		delete(app.sessions, token)
+		app.sessionMutex.Unlock()
+		app.closeSessionClients(token)
+		log.Printf("User %s logged out", s.user)
+	}
+
+	// Replace the cookie requireAuth refreshed rather than sending both
+	w.Header().Del("Set-Cookie")
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookieName,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
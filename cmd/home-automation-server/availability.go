@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func validateAvailability(config *Config) error {
+	for _, device := range config.Devices {
+		if strings.ContainsAny(device.Availability.Topic, "+#") {
+			return fmt.Errorf("device '%s': availability topic cannot contain wildcards", device.ID)
+		}
+		if device.Availability.Timeout < 0 {
+			return fmt.Errorf("device '%s': availability timeout must not be negative", device.ID)
+		}
+	}
+	if strings.ContainsAny(config.MQTT.AvailabilityTopic, "+#") {
+		return fmt.Errorf("mqtt availabilityTopic cannot contain wildcards")
+	}
+	return nil
+}
+
+func availabilityPayloads(online, offline string) (string, string) {
+	if online == "" {
+		online = "online"
+	}
+	if offline == "" {
+		offline = "offline"
+	}
+	return online, offline
+}
+
+// parseAvailability reads an availability payload. Besides the configured
+// plain payloads it accepts Zigbee2MQTT's {"state": "online"} form; case is
+// ignored since Tasmota sends "Online".
+func parseAvailability(availability Availability, payload string) (online bool, ok bool) {
+	onlinePayload, offlinePayload := availabilityPayloads(availability.PayloadOnline, availability.PayloadOffline)
+
+	state := strings.TrimSpace(payload)
+	var object struct {
+		State string `json:"state"`
+	}
+	if strings.HasPrefix(state, "{") && json.Unmarshal([]byte(state), &object) == nil {
+		state = object.State
+	}
+
+	switch {
+	case strings.EqualFold(state, onlinePayload):
+		return true, true
+	case strings.EqualFold(state, offlinePayload):
+		return false, true
+	}
+	return false, false
+}
+
+func availabilityTopics(devices []Device) map[string]bool {
+	topics := make(map[string]bool)
+	for _, device := range devices {
+		if device.Availability.Topic != "" {
+			topics[device.Availability.Topic] = true
+		}
+	}
+	return topics
+}
+
+func (app *App) subscribeToAvailabilityTopics() {
+	for topic := range availabilityTopics(app.getConfig().Devices) {
+		app.subscribeToAvailabilityTopic(topic)
+	}
+}
+
+func (app *App) subscribeToAvailabilityTopic(topic string) {
+	token := app.mqttClient.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		app.logMQTTMessage(msg)
+		app.handleAvailabilityMessage(msg.Topic(), string(msg.Payload()))
+	})
+
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Failed to subscribe to %s: %v", topic, token.Error())
+	} else {
+		log.Printf("Subscribed to availability topic: %s", topic)
+	}
+}
+
+// handleAvailabilityMessage updates every device using topic; bridges often
+// share one availability topic between their devices.
+func (app *App) handleAvailabilityMessage(topic, payload string) {
+	config := app.getConfig()
+	now := time.Now()
+
+	app.statusMutex.Lock()
+	defer app.statusMutex.Unlock()
+
+	for _, device := range config.Devices {
+		if device.Availability.Topic != topic {
+			continue
+		}
+		online, ok := parseAvailability(device.Availability, payload)
+		if !ok {
+			log.Printf("Ignoring unknown availability payload for %s: %s", device.ID, payload)
+			continue
+		}
+		if deviceStatus, exists := app.deviceStatus[device.ID]; exists {
+			deviceStatus.offline = !online
+			app.updateAvailability(device, deviceStatus, now)
+		}
+	}
+}
+
+// updateAvailability recomputes whether a device is available and tells
+// clients when that changes. It must be called with statusMutex held.
+func (app *App) updateAvailability(device Device, deviceStatus *DeviceStatus, now time.Time) {
+	available := !deviceStatus.offline
+	if timeout := device.Availability.Timeout; timeout > 0 && now.Sub(deviceStatus.lastSeen) > time.Duration(timeout)*time.Second {
+		available = false
+	}
+	if available == deviceStatus.Available {
+		return
+	}
+
+	deviceStatus.Available = available
+	if available {
+		log.Printf("Device %s is available", device.ID)
+	} else {
+		log.Printf("Device %s is unavailable", device.ID)
+	}
+	app.broadcastAvailability(device, available)
+}
+
+func (app *App) broadcastAvailability(device Device, available bool) {
+	message := WebSocketMessage{
+		Type:     "availability",
+		DeviceID: device.ID,
+		Data:     map[string]bool{"available": available},
+	}
+	app.broadcastTo(message, func(a *access) bool {
+		return a.canSeeDevice(device)
+	})
+}
+
+// startAvailabilityChecker marks devices with a timeout unavailable once
+// their status goes quiet.
+func (app *App) startAvailabilityChecker() {
+	ticker := time.NewTicker(time.Second)
+	go func() {
+		for now := range ticker.C {
+			config := app.getConfig()
+
+			app.statusMutex.Lock()
+			for _, device := range config.Devices {
+				if device.Availability.Timeout <= 0 {
+					continue
+				}
+				if deviceStatus, exists := app.deviceStatus[device.ID]; exists {
+					app.updateAvailability(device, deviceStatus, now)
+				}
+			}
+			app.statusMutex.Unlock()
+		}
+	}()
+}
+
+// publishServerAvailability announces that this server is online. The
+// matching offline payload is the connection's last will.
+func (app *App) publishServerAvailability() {
+	config := app.getConfig().MQTT
+	if config.AvailabilityTopic == "" {
+		return
+	}
+	online, _ := availabilityPayloads(config.PayloadOnline, config.PayloadOffline)
+	if err := app.publishMQTT(config.AvailabilityTopic, online, true); err != nil {
+		log.Printf("Failed to publish server availability: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// colorValue is the value of an RGB or HSV color control as seen by payload
+// templates. It prints as its hex form.
+type colorValue struct {
+	R, G, B int     // 0-255
+	H       float64 // 0-360
+	S, V    float64 // 0-100
+	Hex     string  // #rrggbb
+}
+
+func (c colorValue) String() string {
+	return c.Hex
+}
+
+// parseHexColor reads "#rrggbb" (the form browsers' color inputs submit).
+func parseHexColor(s string) (colorValue, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) != 6 {
+		return colorValue{}, fmt.Errorf("color must be #rrggbb")
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return colorValue{}, fmt.Errorf("color must be #rrggbb")
+	}
+
+	c := colorValue{
+		R:   int(rgb >> 16 & 0xff),
+		G:   int(rgb >> 8 & 0xff),
+		B:   int(rgb & 0xff),
+		Hex: "#" + strings.ToLower(hex),
+	}
+	c.H, c.S, c.V = rgbToHSV(c.R, c.G, c.B)
+	return c, nil
+}
+
+// rgbToHSV converts to hue in degrees and saturation and value in percent,
+// rounded to one decimal.
+func rgbToHSV(r, g, b int) (float64, float64, float64) {
+	rf, gf, bf := float64(r)/255, float64(g)/255, float64(b)/255
+	max := math.Max(rf, math.Max(gf, bf))
+	min := math.Min(rf, math.Min(gf, bf))
+	delta := max - min
+
+	var h float64
+	switch {
+	case delta == 0:
+		h = 0
+	case max == rf:
+		h = 60 * math.Mod((gf-bf)/delta, 6)
+	case max == gf:
+		h = 60 * ((bf-rf)/delta + 2)
+	default:
+		h = 60 * ((rf-gf)/delta + 4)
+	}
+	if h < 0 {
+		h += 360
+	}
+
+	var s float64
+	if max > 0 {
+		s = delta / max
+	}
+
+	round := func(v float64) float64 { return math.Round(v*10) / 10 }
+	return round(h), round(s * 100), round(max * 100)
+}
+
+// defaultColorPayload formats a color the way Zigbee2MQTT and most JSON
+// lights expect it.
+func defaultColorPayload(control Control, value interface{}) interface{} {
+	switch c := value.(type) {
+	case colorValue:
+		if control.ColorMode == "hsv" {
+			return map[string]interface{}{"color": map[string]float64{"h": c.H, "s": c.S, "v": c.V}}
+		}
+		return map[string]interface{}{"color": map[string]int{"r": c.R, "g": c.G, "b": c.B}}
+	case float64:
+		return map[string]float64{"color_temp": c}
+	}
+	return nil
+}
@@ -1,37 +1,273 @@
 package main
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
-func (app *App) loadConfig(filename string) error {
+// parseConfig reads and validates a configuration file without applying it,
+// so a broken edit can be rejected while the running config stays in place.
+func parseConfig(filename string) (Config, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return fmt.Errorf("failed to read config file '%s': %v", filename, err)
+		return Config{}, fmt.Errorf("failed to read config file '%s': %v", filename, err)
 	}
+	return parseConfigData(data)
+}
 
-	if err := xml.Unmarshal(data, &app.config); err != nil {
-		return fmt.Errorf("failed to parse XML config: %v", err)
+// parseConfigData parses and validates configuration file contents.
+func parseConfigData(data []byte) (Config, error) {
+	var config Config
+
+	if err := xml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse XML config: %v", err)
 	}
 
 	// Set default MQTT log size if not specified
-	if app.config.MQTTLogSize <= 0 {
-		app.config.MQTTLogSize = 20
+	if config.MQTTLogSize <= 0 {
+		config.MQTTLogSize = 20
+	}
+
+	if _, err := mqttScheme(config.MQTT.Scheme); err != nil {
+		return config, err
+	}
+
+	if config.HomeAssistant.DiscoveryPrefix == "" {
+		config.HomeAssistant.DiscoveryPrefix = "homeassistant"
+	}
+
+	if config.Discovery.Sources == "" {
+		config.Discovery.Sources = "homeassistant,tasmota,zigbee2mqtt"
+	}
+	if config.Discovery.HomeAssistantPrefix == "" {
+		config.Discovery.HomeAssistantPrefix = "homeassistant"
+	}
+	if config.Discovery.Zigbee2MQTTBase == "" {
+		config.Discovery.Zigbee2MQTTBase = "zigbee2mqtt"
 	}
 
+	if config.CommandTimeout <= 0 {
+		config.CommandTimeout = 30
+	}
+	if config.CommandLogSize <= 0 {
+		config.CommandLogSize = 50
+	}
+
+	if config.Publish.HistorySize <= 0 {
+		config.Publish.HistorySize = 20
+	}
+
+	if config.TopicTree.MaxTopics <= 0 {
+		config.TopicTree.MaxTopics = 10000
+	}
+
+	if config.State.SaveDelay <= 0 {
+		config.State.SaveDelay = 5
+	}
+
+	if config.Auth.SessionTimeout <= 0 {
+		config.Auth.SessionTimeout = 720
+	}
+	for _, user := range config.Auth.Users {
+		if user.Name == "" || user.PasswordHash == "" {
+			return config, fmt.Errorf("auth users require a name and passwordHash")
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return config, fmt.Errorf("user '%s': invalid passwordHash: %v", user.Name, err)
+		}
+	}
+	// Without users everyone is an admin, so anyone could publish anything
+	// or clear every retained message
+	if config.AllowPublish && !authEnabled(&config) {
+		return config, fmt.Errorf("allowPublish requires auth users")
+	}
+	if config.TopicTree.AllowClear && !authEnabled(&config) {
+		return config, fmt.Errorf("topicTree allowClear requires auth users")
+	}
+
+	if err := validateRoles(&config); err != nil {
+		return config, fmt.Errorf("invalid auth roles: %v", err)
+	}
+
+	if err := validateDevices(&config); err != nil {
+		return config, fmt.Errorf("invalid devices: %v", err)
+	}
+	if err := validateGroups(&config); err != nil {
+		return config, fmt.Errorf("invalid groups: %v", err)
+	}
+
+	if err := validateStatusTopics(&config); err != nil {
+		return config, fmt.Errorf("invalid status topics: %v", err)
+	}
+	if err := validateAvailability(&config); err != nil {
+		return config, fmt.Errorf("invalid availability: %v", err)
+	}
+	if err := validateFields(&config); err != nil {
+		return config, fmt.Errorf("invalid status fields: %v", err)
+	}
+	if err := validateControls(&config); err != nil {
+		return config, fmt.Errorf("invalid controls: %v", err)
+	}
+
+	if err := validateRules(&config); err != nil {
+		return config, fmt.Errorf("invalid rules: %v", err)
+	}
+
+	if err := validateSchedules(&config); err != nil {
+		return config, fmt.Errorf("invalid schedules: %v", err)
+	}
+
+	if err := validateScenes(&config); err != nil {
+		return config, fmt.Errorf("invalid scenes: %v", err)
+	}
+
+	return config, nil
+}
+
+func (app *App) loadConfig(filename string) error {
+	config, err := parseConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	app.configMutex.Lock()
+	app.config = config
+	app.configFile = filename
+	app.configMutex.Unlock()
+
+	logConfig(filename, config)
+	return nil
+}
+
+// getConfig returns a snapshot of the current configuration. Reloads replace
+// the config wholesale, so the snapshot stays consistent while it is used.
+func (app *App) getConfig() Config {
+	app.configMutex.RLock()
+	defer app.configMutex.RUnlock()
+	return app.config
+}
+
+func logConfig(filename string, config Config) {
 	// Debug: Print parsed configuration
 	log.Printf("Loaded configuration from: %s", filename)
-	log.Printf("Loaded %d devices", len(app.config.Devices))
-	for _, device := range app.config.Devices {
+	log.Printf("Loaded %d devices", len(config.Devices))
+	for _, device := range config.Devices {
 		log.Printf("Device: %s (%s)", device.Name, device.ID)
 		for i, control := range device.Controls {
 			log.Printf("  Control %d: Type=%s, Label=%s, Topic='%s', Payload='%s', LocalCommand='%s'",
 				i, control.Type, control.Label, control.Topic, control.Payload, control.LocalCommand)
 		}
 	}
+	log.Printf("Loaded %d rules", len(config.Rules))
+	log.Printf("Loaded %d schedules", len(config.Schedules))
+	if authEnabled(&config) {
+		log.Printf("Authentication enabled for %d users", len(config.Auth.Users))
+	} else {
+		log.Println("WARNING: no users configured, dashboard and control API are open to anyone")
+	}
+}
+
+func (config *Config) findControl(deviceID, label string) (Control, bool) {
+	device, exists := config.findDevice(deviceID)
+	if !exists {
+		return Control{}, false
+	}
+	return deviceControl(device, label)
+}
 
+// invalidConfigError reports an edit that would leave the config file invalid.
+type invalidConfigError struct {
+	err error
+}
+
+func (e invalidConfigError) Error() string {
+	return e.err.Error()
+}
+
+func validateDevices(config *Config) error {
+	seen := make(map[string]bool, len(config.Devices))
+	for i, device := range config.Devices {
+		if device.ID == "" {
+			return fmt.Errorf("device %d: missing id", i)
+		}
+		if seen[device.ID] {
+			return fmt.Errorf("device '%s': duplicate id", device.ID)
+		}
+		seen[device.ID] = true
+	}
 	return nil
 }
+
+// appendConfigElement writes value as a <name> element at the end of the
+// config file's <parent> list, creating the list if needed, and reloads the
+// config. The rest of the file, including comments, is left as written. The
+// edited file is validated before it is written; if it would not load, the
+// file is left alone and an invalidConfigError is returned.
+func (app *App) appendConfigElement(parent, name string, value interface{}) error {
+	app.configEdits.Lock()
+	defer app.configEdits.Unlock()
+
+	app.configMutex.RLock()
+	configFile := app.configFile
+	app.configMutex.RUnlock()
+
+	var element bytes.Buffer
+	encoder := xml.NewEncoder(&element)
+	encoder.Indent("        ", "    ")
+	if err := encoder.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: name}}); err != nil {
+		return fmt.Errorf("failed to encode %s: %v", name, err)
+	}
+	element.WriteString("\n")
+
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	end := bytes.LastIndex(data, []byte("</"+parent+">"))
+	if end < 0 {
+		if end = bytes.LastIndex(data, []byte("</config>")); end < 0 {
+			return fmt.Errorf("config file has no </config> element")
+		}
+		var list bytes.Buffer
+		list.WriteString("    <" + parent + ">\n")
+		list.Write(element.Bytes())
+		list.WriteString("    </" + parent + ">\n")
+		element = list
+	}
+
+	// Insert right before the closing tag, or on its own line when the tag
+	// starts a line
+	at := end
+	lineStart := bytes.LastIndexByte(data[:end], '\n') + 1
+	if len(bytes.TrimSpace(data[lineStart:end])) == 0 {
+		at = lineStart
+	} else {
+		element.Truncate(element.Len() - 1)
+	}
+
+	var updated bytes.Buffer
+	updated.Write(data[:at])
+	updated.Write(element.Bytes())
+	updated.Write(data[at:])
+
+	if _, err := parseConfigData(updated.Bytes()); err != nil {
+		return invalidConfigError{err}
+	}
+
+	if err := writeFileAtomic(configFile, updated.Bytes(), info.Mode()); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+
+	return app.reloadConfig()
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// controlPayloadData is what a control's payload template can refer to, as
+// in {"brightness": {{scale .Value 0 100 0 254 | round}}, "transition": 2}.
+type controlPayloadData struct {
+	Value     interface{}            // slider position (float64), toggle target state (bool), or nil
+	Device    string                 // device ID
+	Status    map[string]interface{} // the device's current status
+	User      string                 // dashboard user, or the schedule that fired
+	Timestamp time.Time
+}
+
+var payloadFuncs = template.FuncMap{
+	// scale maps v from [fromMin, fromMax] onto [toMin, toMax]
+	"scale": func(v, fromMin, fromMax, toMin, toMax float64) (float64, error) {
+		if fromMax == fromMin {
+			return 0, fmt.Errorf("scale: empty source range")
+		}
+		return toMin + (v-fromMin)*(toMax-toMin)/(fromMax-fromMin), nil
+	},
+	"round": func(v float64) int64 {
+		return int64(math.Round(v))
+	},
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func validateControls(config *Config) error {
+	for _, device := range config.Devices {
+		for _, control := range device.Controls {
+			if err := validateControlType(control); err != nil {
+				return fmt.Errorf("device '%s' control '%s': %v", device.ID, control.Label, err)
+			}
+			if control.StateField != "" && control.Type == "button" {
+				return fmt.Errorf("device '%s' control '%s': buttons have no state to reflect", device.ID, control.Label)
+			}
+			if (control.PayloadOn != "" || control.PayloadOff != "") && control.Type != "toggle" {
+				return fmt.Errorf("device '%s' control '%s': payloadOn/payloadOff are only supported on toggles", device.ID, control.Label)
+			}
+			if control.PayloadOn != "" && strings.EqualFold(control.PayloadOn, control.PayloadOff) {
+				return fmt.Errorf("device '%s' control '%s': payloadOn and payloadOff must differ", device.ID, control.Label)
+			}
+			if err := checkPayloadTemplate(device, control); err != nil {
+				return fmt.Errorf("device '%s' control '%s': %v", device.ID, control.Label, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateControlType(control Control) error {
+	switch control.Type {
+	case "button", "slider", "toggle", "text":
+	case "number":
+		if control.Step < 0 {
+			return fmt.Errorf("step must not be negative")
+		}
+	case "color":
+		switch control.ColorMode {
+		case "", "rgb", "hsv":
+		case "temp":
+			if control.Min >= control.Max {
+				return fmt.Errorf("color temperature requires min < max")
+			}
+		default:
+			return fmt.Errorf("unknown colorMode '%s'", control.ColorMode)
+		}
+	case "select":
+		if len(control.Options) == 0 {
+			return fmt.Errorf("select requires at least one option")
+		}
+		seen := make(map[string]bool)
+		for _, option := range control.Options {
+			if option.Value == "" {
+				return fmt.Errorf("select options require a value")
+			}
+			if seen[option.Value] {
+				return fmt.Errorf("duplicate option '%s'", option.Value)
+			}
+			seen[option.Value] = true
+		}
+	default:
+		return fmt.Errorf("unknown control type '%s'", control.Type)
+	}
+
+	if control.Pattern != "" {
+		if control.Type != "text" {
+			return fmt.Errorf("pattern is only supported on text controls")
+		}
+		if _, err := textPattern(control); err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+	}
+	return nil
+}
+
+// textPattern compiles a text control's pattern to match the whole value,
+// like the HTML pattern attribute.
+func textPattern(control Control) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + control.Pattern + ")$")
+}
+
+// boundedNumber reports whether a number control limits its range. Number
+// controls without min and max accept any value.
+func boundedNumber(control Control) bool {
+	return control.Min != 0 || control.Max != 0
+}
+
+// controlState reads the current value of a control from a device status:
+// a slider position, the on/off state of a toggle, a color, or the value of
+// an input. Toggles without payloadOn/payloadOff accept the usual boolean
+// spellings ("ON", "true", 1, ...).
+func controlState(control Control, status map[string]interface{}) (interface{}, bool) {
+	if control.StateField == "" {
+		return nil, false
+	}
+	raw, found := lookupFieldPath(status, control.StateField)
+	if !found {
+		return nil, false
+	}
+
+	switch control.Type {
+	case "slider", "number":
+		return fieldNumber(raw)
+	case "select", "text":
+		return fieldString(raw), raw != nil
+	case "color":
+		if control.ColorMode == "temp" {
+			return fieldNumber(raw)
+		}
+		c, err := parseHexColor(fieldString(raw))
+		return c.Hex, err == nil
+	case "toggle":
+		if control.PayloadOn == "" && control.PayloadOff == "" {
+			return fieldBool(raw)
+		}
+		value := fieldString(raw)
+		switch {
+		case control.PayloadOn != "" && strings.EqualFold(value, control.PayloadOn):
+			return true, true
+		case control.PayloadOff != "" && strings.EqualFold(value, control.PayloadOff):
+			return false, true
+		case control.PayloadOff == "":
+			// Only the on value is known; anything else is off
+			return false, true
+		case control.PayloadOn == "":
+			return true, true
+		}
+	}
+	return nil, false
+}
+
+// controlStates resolves every control of device that reflects a status
+// field, keyed by label. It returns nil when there are none.
+func controlStates(device Device, status map[string]interface{}) map[string]interface{} {
+	var states map[string]interface{}
+	for _, control := range device.Controls {
+		state, ok := controlState(control, status)
+		if !ok {
+			continue
+		}
+		if states == nil {
+			states = make(map[string]interface{})
+		}
+		states[control.Label] = state
+	}
+	return states
+}
+
+func parsePayloadTemplate(control Control) (*template.Template, error) {
+	return template.New(control.Label).Funcs(payloadFuncs).Parse(control.Payload)
+}
+
+// checkPayloadTemplate parses a control's payload and renders it once with
+// a representative value, so typos in field or function names are reported
+// when the config is loaded rather than when the control is first used.
+func checkPayloadTemplate(device Device, control Control) error {
+	tmpl, err := parsePayloadTemplate(control)
+	if err != nil {
+		return fmt.Errorf("invalid payload template: %v", err)
+	}
+
+	var value interface{}
+	switch control.Type {
+	case "slider", "number":
+		value = float64(control.Min)
+	case "toggle":
+		value = true
+	case "color":
+		if control.ColorMode == "temp" {
+			value = float64(control.Min)
+		} else {
+			value, _ = parseHexColor("#ffffff")
+		}
+	case "select":
+		value = control.Options[0].Value
+	case "text":
+		value = ""
+	}
+	data := controlPayloadData{
+		Value:     value,
+		Device:    device.ID,
+		Status:    map[string]interface{}{},
+		Timestamp: time.Now(),
+	}
+	if err := tmpl.Execute(&strings.Builder{}, data); err != nil {
+		return fmt.Errorf("invalid payload template: %v", err)
+	}
+	return nil
+}
+
+// controlValue validates the value submitted with a control against its
+// definition. Toggles may name the state to switch to; buttons take no value.
+func controlValue(control Control, value interface{}) (interface{}, error) {
+	switch control.Type {
+	case "slider":
+		position, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("slider value must be a number")
+		}
+		if position < float64(control.Min) || position > float64(control.Max) {
+			return nil, fmt.Errorf("slider value must be between %d and %d", control.Min, control.Max)
+		}
+		return position, nil
+	case "toggle":
+		if value == nil {
+			return nil, nil
+		}
+		on, ok := fieldBool(value)
+		if !ok {
+			return nil, fmt.Errorf("toggle value must be true or false")
+		}
+		return on, nil
+	case "number":
+		number, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, fmt.Errorf("value must be a number")
+		}
+		if boundedNumber(control) && (number < float64(control.Min) || number > float64(control.Max)) {
+			return nil, fmt.Errorf("value must be between %d and %d", control.Min, control.Max)
+		}
+		if control.Step > 0 {
+			steps := (number - float64(control.Min)) / control.Step
+			if math.Abs(steps-math.Round(steps)) > 1e-9 {
+				return nil, fmt.Errorf("value must be a multiple of %g from %d", control.Step, control.Min)
+			}
+		}
+		return number, nil
+	case "color":
+		if control.ColorMode == "temp" {
+			temp, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+			if err != nil {
+				return nil, fmt.Errorf("color temperature must be a number")
+			}
+			if temp < float64(control.Min) || temp > float64(control.Max) {
+				return nil, fmt.Errorf("color temperature must be between %d and %d", control.Min, control.Max)
+			}
+			return temp, nil
+		}
+		text, _ := value.(string)
+		return parseHexColor(text)
+	case "select":
+		text, _ := value.(string)
+		for _, option := range control.Options {
+			if option.Value == text {
+				return text, nil
+			}
+		}
+		return nil, fmt.Errorf("'%s' is not an option", text)
+	case "text":
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("value must be a string")
+		}
+		if control.MaxLength > 0 && utf8.RuneCountInString(text) > control.MaxLength {
+			return nil, fmt.Errorf("value must be at most %d characters", control.MaxLength)
+		}
+		if control.Pattern != "" {
+			pattern, err := textPattern(control)
+			if err != nil || !pattern.MatchString(text) {
+				return nil, fmt.Errorf("value does not match the required format")
+			}
+		}
+		return text, nil
+	}
+	return nil, nil
+}
+
+// renderControlPayload builds the MQTT payload for a control from its payload
+// template. Without a payload, sliders send {"<label>": <position>}, colors
+// their JSON color, and number, select and text controls the value itself.
+func renderControlPayload(control Control, data controlPayloadData) (string, error) {
+	if control.Payload == "" && data.Value != nil {
+		switch control.Type {
+		case "slider":
+			position, _ := data.Value.(float64)
+			payload, err := json.Marshal(map[string]float64{strings.ToLower(control.Label): position})
+			return string(payload), err
+		case "color":
+			payload, err := json.Marshal(defaultColorPayload(control, data.Value))
+			return string(payload), err
+		case "number", "select", "text":
+			return fieldString(data.Value), nil
+		}
+	}
+
+	tmpl, err := parsePayloadTemplate(control)
+	if err != nil {
+		return "", err
+	}
+	var payload strings.Builder
+	if err := tmpl.Execute(&payload, data); err != nil {
+		return "", err
+	}
+	return payload.String(), nil
+}
+
+// controlPayload renders a control's payload against the device's current
+// status.
+func (app *App) controlPayload(deviceID string, control Control, value interface{}, user string) (string, error) {
+	data := controlPayloadData{
+		Value:     value,
+		Device:    deviceID,
+		Status:    make(map[string]interface{}),
+		User:      user,
+		Timestamp: time.Now(),
+	}
+
+	app.statusMutex.RLock()
+	if deviceStatus, exists := app.deviceStatus[deviceID]; exists {
+		for key, value := range deviceStatus.Status {
+			data.Status[key] = value
+		}
+	}
+	app.statusMutex.RUnlock()
+
+	return renderControlPayload(control, data)
+}
+
+// runControl performs a control with a value as submitted by a client. For a
+// group, each member's control of the same label is set to the value.
+func (app *App) runControl(device Device, control Control, raw interface{}, user, source string) (string, error) {
+	if len(device.Members) > 0 {
+		config := app.getConfig()
+		var failed []string
+		for _, memberID := range device.Members {
+			member, _ := config.findDevice(memberID)
+			c, exists := deviceControl(member, control.Label)
+			if !exists {
+				continue
+			}
+			if _, err := app.setControl(member, c, raw, user, source); err != nil {
+				log.Printf("Group '%s': failed to set '%s' on %s: %v", device.ID, control.Label, memberID, err)
+				failed = append(failed, memberID)
+			}
+		}
+		if len(failed) > 0 {
+			return "", fmt.Errorf("failed on %s", strings.Join(failed, ", "))
+		}
+		return "", nil
+	}
+
+	value, err := controlValue(control, raw)
+	if err != nil {
+		return "", err
+	}
+	payload, err := app.controlPayload(device.ID, control, value, user)
+	if err != nil {
+		return "", fmt.Errorf("failed to render payload: %v", err)
+	}
+	return app.triggerControl(device.ID, control, payload, source)
+}
+
+// setControl is runControl for callers that set a state rather than press a
+// control: toggles that already report the wanted state are left alone, so
+// toggles whose payload only flips the device still end up right.
+func (app *App) setControl(device Device, control Control, raw interface{}, user, source string) (string, error) {
+	if control.Type == "toggle" && raw != nil && len(device.Members) == 0 {
+		if want, ok := fieldBool(raw); ok {
+			app.statusMutex.RLock()
+			var current interface{}
+			var known bool
+			if deviceStatus, exists := app.deviceStatus[device.ID]; exists {
+				current, known = controlState(control, deviceStatus.Status)
+			}
+			app.statusMutex.RUnlock()
+			if known && current == want {
+				return "", nil
+			}
+		}
+	}
+	return app.runControl(device, control, raw, user, source)
+}
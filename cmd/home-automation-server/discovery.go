@@ -0,0 +1,662 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	sourceHomeAssistant = "homeassistant"
+	sourceTasmota       = "tasmota"
+	sourceZigbee2MQTT   = "zigbee2mqtt"
+
+	discoveredCategory = "discovered"
+
+	// discoveryApplyDelay is how long discovery messages are collected before
+	// the device list is rebuilt.
+	discoveryApplyDelay = 500 * time.Millisecond
+)
+
+// discoveryState holds devices announced over MQTT, per source. Discovered
+// devices are merged into the config's device list, so they can be viewed
+// and controlled like configured ones until the config defines the same ID.
+type discoveryState struct {
+	mutex      sync.Mutex
+	haEntities map[string]haDiscoveredEntity // by config topic
+	tasmota    map[string]Device             // by config topic
+	zigbee     []Device
+	changed    chan struct{} // signals applyDiscoveryChanges
+}
+
+// haDiscoveredEntity is the part of a Home Assistant entity we turn into a
+// device: the controls it adds and the topic it reports state on.
+type haDiscoveredEntity struct {
+	deviceID    string
+	deviceName  string
+	statusTopic StatusTopic
+	controls    []Control
+}
+
+func newDiscoveryState() *discoveryState {
+	return &discoveryState{
+		haEntities: make(map[string]haDiscoveredEntity),
+		tasmota:    make(map[string]Device),
+		changed:    make(chan struct{}, 1),
+	}
+}
+
+// devices returns all discovered devices sorted by ID.
+func (d *discoveryState) devices() []Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	byID := make(map[string]*Device)
+	topics := make([]string, 0, len(d.haEntities))
+	for topic := range d.haEntities {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		entity := d.haEntities[topic]
+		device, exists := byID[entity.deviceID]
+		if !exists {
+			device = &Device{
+				ID:       entity.deviceID,
+				Name:     entity.deviceName,
+				Category: discoveredCategory,
+				Source:   sourceHomeAssistant,
+			}
+			byID[entity.deviceID] = device
+		}
+		if entity.statusTopic.Topic != "" && !device.hasStatusTopic(entity.statusTopic.Topic) {
+			device.StatusTopics = append(device.StatusTopics, entity.statusTopic)
+		}
+		device.Controls = append(device.Controls, entity.controls...)
+	}
+
+	devices := make([]Device, 0, len(byID)+len(d.tasmota)+len(d.zigbee))
+	for _, device := range byID {
+		devices = append(devices, *device)
+	}
+	for _, device := range d.tasmota {
+		devices = append(devices, device)
+	}
+	devices = append(devices, d.zigbee...)
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	return devices
+}
+
+// withDiscoveredDevices appends discovered devices to the config's own
+// devices. Configured devices win when both use the same ID, and discovered
+// devices that fail validation are dropped, since announcements come from
+// whatever can publish to the broker.
+func (app *App) withDiscoveredDevices(config *Config) []Device {
+	devices := make([]Device, 0, len(config.Devices))
+	for _, device := range config.Devices {
+		if device.Source == "" {
+			devices = append(devices, device)
+		}
+	}
+	if app.discovery == nil {
+		return devices
+	}
+
+	configured := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		configured[device.ID] = true
+	}
+	for _, device := range app.discovery.devices() {
+		if configured[device.ID] {
+			continue // e.g. promoted into the config file
+		}
+		if err := validateDiscoveredDevice(config.Groups, devices, device); err != nil {
+			log.Printf("Ignoring device %s discovered via %s: %v", device.ID, device.Source, err)
+			continue
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// validateDiscoveredDevice runs the config's device validators: those that
+// compare devices over the devices accepted so far plus device, the others
+// over device alone, since accepted devices have passed them already.
+func validateDiscoveredDevice(groups []Group, accepted []Device, device Device) error {
+	own := Config{Devices: []Device{device}}
+	for _, validate := range []func(*Config) error{validateFields, validateControls} {
+		if err := validate(&own); err != nil {
+			return err
+		}
+	}
+
+	all := Config{
+		Devices: append(append([]Device{}, accepted...), device),
+		Groups:  groups,
+	}
+	for _, validate := range []func(*Config) error{validateDevices, validateGroups, validateStatusTopics, validateAvailability} {
+		if err := validate(&all); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyDiscoveredDevices rebuilds the running device list after a discovery
+// message and updates status subscriptions to match.
+func (app *App) applyDiscoveredDevices() {
+	app.devicesMutex.Lock()
+	defer app.devicesMutex.Unlock()
+
+	app.configMutex.Lock()
+	oldDevices := app.config.Devices
+	newDevices := app.withDiscoveredDevices(&app.config)
+	app.config.Devices = newDevices
+	app.configMutex.Unlock()
+
+	if reflect.DeepEqual(oldDevices, newDevices) {
+		return
+	}
+
+	app.applyDeviceChanges(oldDevices, newDevices)
+	app.broadcastMessage(WebSocketMessage{
+		Type: "devices_discovered",
+	})
+}
+
+// discoveryChanged asks applyDiscoveryChanges to rebuild the device list
+// without blocking the MQTT handler.
+func (app *App) discoveryChanged() {
+	select {
+	case app.discovery.changed <- struct{}{}:
+	default: // a rebuild is already pending
+	}
+}
+
+// applyDiscoveryChanges rebuilds the device list once per burst of discovery
+// messages, such as the retained configs replayed after subscribing, rather
+// than once per message.
+func (app *App) applyDiscoveryChanges() {
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-app.discovery.changed:
+			if pending == nil {
+				pending = time.After(discoveryApplyDelay)
+			}
+		case <-pending:
+			pending = nil
+			app.applyDiscoveredDevices()
+		}
+	}
+}
+
+func (app *App) subscribeDiscovery() {
+	config := app.getConfig()
+	if app.discovery == nil {
+		return
+	}
+
+	handlers := make(map[string]mqtt.MessageHandler)
+	if listContains(config.Discovery.Sources, sourceHomeAssistant) {
+		handlers[strings.TrimSuffix(config.Discovery.HomeAssistantPrefix, "/")+"/#"] = app.onHomeAssistantDiscovery
+	}
+	if listContains(config.Discovery.Sources, sourceTasmota) {
+		handlers["tasmota/discovery/+/config"] = app.onTasmotaDiscovery
+	}
+	if listContains(config.Discovery.Sources, sourceZigbee2MQTT) {
+		handlers[strings.TrimSuffix(config.Discovery.Zigbee2MQTTBase, "/")+"/bridge/devices"] = app.onZigbee2MQTTDevices
+	}
+
+	for topic, handler := range handlers {
+		token := app.mqttClient.Subscribe(topic, 1, handler)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Discovery: failed to subscribe to %s: %v", topic, token.Error())
+		} else {
+			log.Printf("Discovery: subscribed to %s", topic)
+		}
+	}
+}
+
+// Home Assistant allows abbreviated keys in discovery payloads; these are the
+// ones we read.
+var haAbbreviations = map[string]string{
+	"cmd_t":   "command_topic",
+	"stat_t":  "state_topic",
+	"pl_on":   "payload_on",
+	"pl_off":  "payload_off",
+	"pl_prs":  "payload_press",
+	"uniq_id": "unique_id",
+	"obj_id":  "object_id",
+	"dev":     "device",
+	"ids":     "identifiers",
+	"mf":      "manufacturer",
+	"mdl":     "model",
+}
+
+// expandHomeAssistantPayload replaces abbreviated keys and expands the "~"
+// base topic so the payload can be decoded into haEntity.
+func expandHomeAssistantPayload(raw map[string]interface{}) map[string]interface{} {
+	base, _ := raw["~"].(string)
+	expanded := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		if full, exists := haAbbreviations[key]; exists {
+			key = full
+		}
+		switch v := value.(type) {
+		case string:
+			if base != "" && strings.HasSuffix(key, "_topic") {
+				if strings.HasPrefix(v, "~") {
+					v = base + v[1:]
+				} else if strings.HasSuffix(v, "~") {
+					v = v[:len(v)-1] + base
+				}
+			}
+			value = v
+		case map[string]interface{}:
+			value = expandHomeAssistantPayload(v)
+		}
+		// identifiers may be a single string
+		if key == "identifiers" {
+			if s, ok := value.(string); ok {
+				value = []string{s}
+			}
+		}
+		expanded[key] = value
+	}
+	return expanded
+}
+
+func (app *App) onHomeAssistantDiscovery(client mqtt.Client, msg mqtt.Message) {
+	config := app.getConfig()
+
+	// <prefix>/<component>/[<node_id>/]<object_id>/config
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), strings.TrimSuffix(config.Discovery.HomeAssistantPrefix, "/")+"/"), "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[len(parts)-1] != "config" {
+		return
+	}
+	component := parts[0]
+	objectID := parts[len(parts)-2]
+	if len(parts) == 4 && parts[1] == haNodeID(&config) {
+		return // published by our own Home Assistant discovery
+	}
+
+	entity, ok := parseHomeAssistantEntity(component, objectID, msg.Payload())
+
+	app.discovery.mutex.Lock()
+	if ok {
+		app.discovery.haEntities[msg.Topic()] = entity
+	} else {
+		delete(app.discovery.haEntities, msg.Topic())
+	}
+	app.discovery.mutex.Unlock()
+
+	app.discoveryChanged()
+}
+
+// parseHomeAssistantEntity converts one discovery config. Switches and
+// lights become On/Off buttons since their on and off payloads differ.
+func parseHomeAssistantEntity(component, objectID string, payload []byte) (haDiscoveredEntity, bool) {
+	var raw map[string]interface{}
+	if len(payload) == 0 || json.Unmarshal(payload, &raw) != nil {
+		return haDiscoveredEntity{}, false
+	}
+
+	data, err := json.Marshal(expandHomeAssistantPayload(raw))
+	if err != nil {
+		return haDiscoveredEntity{}, false
+	}
+	var config struct {
+		haEntity
+		ObjectID string `json:"object_id"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.Printf("Discovery: ignoring Home Assistant %s/%s: %v", component, objectID, err)
+		return haDiscoveredEntity{}, false
+	}
+
+	entity := haDiscoveredEntity{
+		deviceName: config.Device.Name,
+	}
+	switch {
+	case len(config.Device.Identifiers) > 0:
+		entity.deviceID = "ha-" + haSlug(config.Device.Identifiers[0])
+	case config.UniqueID != "":
+		entity.deviceID = "ha-" + haSlug(config.UniqueID)
+	default:
+		entity.deviceID = "ha-" + haSlug(objectID)
+	}
+	if entity.deviceName == "" {
+		entity.deviceName = config.Name
+	}
+	if entity.deviceName == "" {
+		entity.deviceName = objectID
+	}
+
+	label := config.Name
+	if label == "" {
+		label = "Power"
+	}
+
+	switch component {
+	case "switch", "light", "fan":
+		on, off := config.PayloadOn, config.PayloadOff
+		if on == "" {
+			on = "ON"
+		}
+		if off == "" {
+			off = "OFF"
+		}
+		if config.CommandTopic != "" {
+			entity.controls = []Control{
+				{Type: "button", Label: label + " On", Topic: config.CommandTopic, Payload: on},
+				{Type: "button", Label: label + " Off", Topic: config.CommandTopic, Payload: off},
+			}
+		}
+		entity.statusTopic = haStatusTopic(config.haEntity, label)
+	case "button":
+		press := config.PayloadPress
+		if press == "" {
+			press = "PRESS"
+		}
+		if config.CommandTopic != "" {
+			entity.controls = []Control{{Type: "button", Label: label, Topic: config.CommandTopic, Payload: press}}
+		}
+	case "sensor", "binary_sensor":
+		entity.statusTopic = haStatusTopic(config.haEntity, label)
+	default:
+		return haDiscoveredEntity{}, false
+	}
+
+	if entity.statusTopic.Topic == "" && len(entity.controls) == 0 {
+		return haDiscoveredEntity{}, false
+	}
+	return entity, true
+}
+
+// haStatusTopic binds a plain state topic (ON/OFF, a reading) to a field
+// named after the entity, so several entities of one device don't overwrite
+// each other's "value". State read through a value template is JSON shared
+// with other entities and is merged as is.
+func haStatusTopic(config haEntity, label string) StatusTopic {
+	statusTopic := StatusTopic{Topic: config.StateTopic}
+	if config.ValueTemplate == "" {
+		statusTopic.Field = haSlug(label)
+	}
+	return statusTopic
+}
+
+// tasmotaConfig is the subset of tasmota/discovery/<mac>/config we use.
+type tasmotaConfig struct {
+	DeviceName    string    `json:"dn"`
+	FriendlyNames []*string `json:"fn"`
+	Hostname      string    `json:"hn"`
+	MAC           string    `json:"mac"`
+	Topic         string    `json:"t"`
+	FullTopic     string    `json:"ft"`
+	Prefixes      []string  `json:"tp"` // cmnd, stat, tele
+	Relays        []int     `json:"rl"`
+}
+
+func (c tasmotaConfig) topic(prefix int) string {
+	if prefix >= len(c.Prefixes) {
+		return ""
+	}
+	mac := c.MAC
+	if len(mac) > 6 {
+		mac = mac[len(mac)-6:]
+	}
+	return strings.NewReplacer(
+		"%prefix%", c.Prefixes[prefix],
+		"%topic%", c.Topic,
+		"%hostname%", c.Hostname,
+		"%id%", mac,
+	).Replace(c.FullTopic)
+}
+
+func (app *App) onTasmotaDiscovery(client mqtt.Client, msg mqtt.Message) {
+	device, ok := parseTasmotaDevice(msg.Payload())
+
+	app.discovery.mutex.Lock()
+	if ok {
+		app.discovery.tasmota[msg.Topic()] = device
+	} else {
+		delete(app.discovery.tasmota, msg.Topic())
+	}
+	app.discovery.mutex.Unlock()
+
+	app.discoveryChanged()
+}
+
+// parseTasmotaDevice turns each relay into a toggle sending POWER<n> TOGGLE
+// and reads status from the periodic tele STATE message and command results.
+func parseTasmotaDevice(payload []byte) (Device, bool) {
+	var config tasmotaConfig
+	if len(payload) == 0 || json.Unmarshal(payload, &config) != nil || config.Topic == "" || len(config.Prefixes) < 3 {
+		return Device{}, false
+	}
+
+	device := Device{
+		ID:       "tasmota-" + haSlug(config.Topic),
+		Name:     config.DeviceName,
+		Category: discoveredCategory,
+		StatusTopics: []StatusTopic{
+			{Topic: config.topic(2) + "STATE"},
+			{Topic: config.topic(1) + "RESULT"}, // command replies, e.g. {"POWER":"ON"}
+		},
+		Refresh: StatusRefresh{Topic: config.topic(0) + "STATE"},
+		Source:  sourceTasmota,
+	}
+	if device.Name == "" {
+		device.Name = config.Topic
+	}
+
+	relays := 0
+	for _, relay := range config.Relays {
+		if relay != 0 {
+			relays++
+		}
+	}
+	for i, relay := range config.Relays {
+		if relay == 0 {
+			continue
+		}
+		command := "POWER"
+		if relays > 1 {
+			command = fmt.Sprintf("POWER%d", i+1)
+		}
+		label := command
+		if i < len(config.FriendlyNames) && config.FriendlyNames[i] != nil && *config.FriendlyNames[i] != "" {
+			label = *config.FriendlyNames[i]
+		}
+		device.Controls = append(device.Controls, Control{
+			Type:    "toggle",
+			Label:   label,
+			Topic:   config.topic(0) + command,
+			Payload: "TOGGLE",
+
+			StateField: command,
+			PayloadOn:  "ON",
+			PayloadOff: "OFF",
+		})
+	}
+
+	return device, true
+}
+
+// zigbee2mqttDevice is the subset of an entry in <base>/bridge/devices we use.
+type zigbee2mqttDevice struct {
+	FriendlyName string `json:"friendly_name"`
+	Type         string `json:"type"`
+	Definition   *struct {
+		Model   string              `json:"model"`
+		Exposes []zigbee2mqttExpose `json:"exposes"`
+	} `json:"definition"`
+}
+
+type zigbee2mqttExpose struct {
+	Type     string              `json:"type"`
+	Property string              `json:"property"`
+	Access   int                 `json:"access"`
+	ValueMin *float64            `json:"value_min"`
+	ValueMax *float64            `json:"value_max"`
+	Features []zigbee2mqttExpose `json:"features"`
+}
+
+// Zigbee2MQTT access bit for properties that can be set
+const zigbee2mqttAccessSet = 2
+
+func (app *App) onZigbee2MQTTDevices(client mqtt.Client, msg mqtt.Message) {
+	base := strings.TrimSuffix(app.getConfig().Discovery.Zigbee2MQTTBase, "/")
+
+	var entries []zigbee2mqttDevice
+	if len(msg.Payload()) > 0 {
+		if err := json.Unmarshal(msg.Payload(), &entries); err != nil {
+			log.Printf("Discovery: ignoring Zigbee2MQTT device list: %v", err)
+			return
+		}
+	}
+
+	devices := make([]Device, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type == "Coordinator" || entry.Definition == nil || entry.FriendlyName == "" {
+			continue
+		}
+		devices = append(devices, parseZigbee2MQTTDevice(base, entry))
+	}
+
+	app.discovery.mutex.Lock()
+	app.discovery.zigbee = devices
+	app.discovery.mutex.Unlock()
+
+	app.discoveryChanged()
+}
+
+// parseZigbee2MQTTDevice maps a settable state to a toggle and settable
+// numeric properties to sliders. Slider payloads are {"<property>": value},
+// which is what Zigbee2MQTT expects on <base>/<name>/set.
+func parseZigbee2MQTTDevice(base string, entry zigbee2mqttDevice) Device {
+	topic := base + "/" + entry.FriendlyName
+	device := Device{
+		ID:           "z2m-" + haSlug(entry.FriendlyName),
+		Name:         entry.FriendlyName,
+		Category:     discoveredCategory,
+		StatusTopics: []StatusTopic{{Topic: topic}},
+		Source:       sourceZigbee2MQTT,
+	}
+
+	var walk func(exposes []zigbee2mqttExpose)
+	walk = func(exposes []zigbee2mqttExpose) {
+		for _, expose := range exposes {
+			walk(expose.Features)
+			if expose.Access&zigbee2mqttAccessSet == 0 || expose.Property == "" {
+				continue
+			}
+
+			switch {
+			case expose.Type == "binary" && expose.Property == "state":
+				device.Controls = append(device.Controls, Control{
+					Type:    "toggle",
+					Label:   "Power",
+					Topic:   topic + "/set",
+					Payload: `{"state":"TOGGLE"}`,
+
+					StateField: "state",
+					PayloadOn:  "ON",
+					PayloadOff: "OFF",
+				})
+				device.Refresh = StatusRefresh{Topic: topic + "/get", Payload: `{"state":""}`}
+			case expose.Type == "numeric" && expose.ValueMin != nil && expose.ValueMax != nil:
+				device.Controls = append(device.Controls, Control{
+					Type:  "slider",
+					Label: strings.ToUpper(expose.Property[:1]) + expose.Property[1:],
+					Topic: topic + "/set",
+					Min:   int(*expose.ValueMin),
+					Max:   int(*expose.ValueMax),
+
+					StateField: expose.Property,
+				})
+			}
+		}
+	}
+	walk(entry.Definition.Exposes)
+
+	return device
+}
+
+func (app *App) handleDiscovered(w http.ResponseWriter, r *http.Request) {
+	config := app.getConfig()
+	userAccess := app.accessFor(r)
+
+	devices := make([]Device, 0)
+	for _, device := range config.Devices {
+		if device.Source != "" && userAccess.canSeeDevice(device) {
+			devices = append(devices, device)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// handlePromote writes a discovered device into the config file so it
+// survives restarts and can be edited like any other device.
+func (app *App) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.accessFor(r).isAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	config := app.getConfig()
+	device, exists := config.findDevice(req.ID)
+	if !exists || device.Source == "" {
+		http.Error(w, fmt.Sprintf("'%s' is not a discovered device", req.ID), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.promoteDevice(device); err != nil {
+		log.Printf("Failed to promote device %s: %v", req.ID, err)
+		status := http.StatusInternalServerError
+		if _, invalid := err.(invalidConfigError); invalid {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// promoteDevice appends a discovered device to the config file. The edit is
+// validated first, so a device whose ID the file already uses is rejected.
+func (app *App) promoteDevice(device Device) error {
+	device.Source = ""
+	if err := app.appendConfigElement("devices", "device", device); err != nil {
+		return err
+	}
+
+	log.Printf("Promoted discovered device %s into %s", device.ID, app.configFile)
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateFields(config *Config) error {
+	for _, device := range config.Devices {
+		names := make(map[string]bool)
+		for i, field := range device.Fields {
+			if !fieldNamePattern.MatchString(field.Name) {
+				return fmt.Errorf("device '%s' field %d: name must be letters, digits, '_' or '-'", device.ID, i)
+			}
+			if names[field.Name] {
+				return fmt.Errorf("device '%s': duplicate field '%s'", device.ID, field.Name)
+			}
+			names[field.Name] = true
+
+			switch field.Type {
+			case "", "number", "int", "bool", "string":
+			default:
+				return fmt.Errorf("device '%s' field '%s': unknown type '%s'", device.ID, field.Name, field.Type)
+			}
+			if _, err := parseEnumLabels(field.Enum); err != nil {
+				return fmt.Errorf("device '%s' field '%s': %v", device.ID, field.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseEnumLabels reads "raw:label,raw:label" into a map.
+func parseEnumLabels(enum string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if strings.TrimSpace(enum) == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(enum, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("enum entry '%s' must be raw:label", strings.TrimSpace(pair))
+		}
+		labels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// splitFieldPath splits a dotted path, honouring "\." for keys that contain
+// dots.
+func splitFieldPath(path string) []string {
+	var parts []string
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path):
+			i++
+			current.WriteByte(path[i])
+		case path[i] == '.':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(path[i])
+		}
+	}
+	return append(parts, current.String())
+}
+
+// lookupFieldPath resolves a gjson-style path such as "state.temperature",
+// "sensors.0.value" or "readings.#" (array length) in a decoded payload. An
+// empty path or "@this" selects the whole payload.
+func lookupFieldPath(data interface{}, path string) (interface{}, bool) {
+	if path == "" || path == "@this" {
+		return data, true
+	}
+
+	current := data
+	for _, key := range splitFieldPath(path) {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, exists := node[key]
+			if !exists {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			if key == "#" {
+				current = float64(len(node))
+				continue
+			}
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// mapFieldValue applies a field's enum labels, type and scale to a raw value.
+func mapFieldValue(field FieldMapping, raw interface{}) (interface{}, bool) {
+	if labels, _ := parseEnumLabels(field.Enum); len(labels) > 0 {
+		if label, exists := labels[fieldString(raw)]; exists {
+			raw = label
+		}
+	}
+
+	value := raw
+	switch field.Type {
+	case "number", "int":
+		number, ok := fieldNumber(raw)
+		if !ok {
+			return nil, false
+		}
+		if field.Scale != 0 {
+			number *= field.Scale
+		}
+		if field.Type == "int" {
+			number = math.Round(number)
+		}
+		return number, true
+	case "bool":
+		b, ok := fieldBool(raw)
+		if !ok {
+			return nil, false
+		}
+		return b, true
+	case "string":
+		return fieldString(raw), true
+	}
+
+	if number, ok := value.(float64); ok && field.Scale != 0 {
+		value = number * field.Scale
+	}
+	return value, true
+}
+
+func fieldString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func fieldNumber(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func fieldBool(v interface{}) (bool, bool) {
+	switch value := v.(type) {
+	case bool:
+		return value, true
+	case float64:
+		return value != 0, true
+	case string:
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "true", "on", "1", "yes", "open":
+			return true, true
+		case "false", "off", "0", "no", "closed":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// applyFieldMappings sets each mapped field found in data on status. Fields
+// whose path is missing from this payload keep their previous value.
+func applyFieldMappings(fields []FieldMapping, data interface{}, status map[string]interface{}) {
+	for _, field := range fields {
+		raw, found := lookupFieldPath(data, field.Path)
+		if !found {
+			continue
+		}
+		if value, ok := mapFieldValue(field, raw); ok {
+			status[field.Name] = value
+		}
+	}
+}
+
+// setTopicField stores a payload received on a status topic bound to a field
+// name, applying the device's field mapping of that name if it has one.
+func setTopicField(device Device, name string, data interface{}, status map[string]interface{}) {
+	for _, field := range device.Fields {
+		if field.Name == name {
+			applyFieldMappings([]FieldMapping{field}, data, status)
+			return
+		}
+	}
+	status[name] = data
+}
+
+// fieldUnits returns the configured unit of each mapped field.
+func fieldUnits(device Device) map[string]string {
+	var units map[string]string
+	for _, field := range device.Fields {
+		if field.Unit == "" {
+			continue
+		}
+		if units == nil {
+			units = make(map[string]string)
+		}
+		units[field.Name] = field.Unit
+	}
+	return units
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+func validateGroups(config *Config) error {
+	devices := make(map[string]bool, len(config.Devices))
+	for _, device := range config.Devices {
+		devices[device.ID] = true
+	}
+
+	seen := make(map[string]bool)
+	for i, group := range config.Groups {
+		if group.ID == "" {
+			return fmt.Errorf("group %d: missing id", i)
+		}
+		if seen[group.ID] || devices[group.ID] {
+			return fmt.Errorf("group '%s': duplicate id", group.ID)
+		}
+		seen[group.ID] = true
+
+		members := group.memberIDs()
+		if len(members) == 0 {
+			return fmt.Errorf("group '%s': requires at least one member", group.ID)
+		}
+		for _, member := range members {
+			if !devices[member] {
+				return fmt.Errorf("group '%s': unknown member device '%s'", group.ID, member)
+			}
+		}
+
+		switch group.Aggregate {
+		case "", "any", "all":
+		default:
+			return fmt.Errorf("group '%s': aggregate must be 'any' or 'all'", group.ID)
+		}
+	}
+	return nil
+}
+
+func (group Group) memberIDs() []string {
+	var members []string
+	for _, member := range strings.Split(group.Members, ",") {
+		if member = strings.TrimSpace(member); member != "" {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+func (config *Config) findGroup(id string) (Group, bool) {
+	for _, group := range config.Groups {
+		if group.ID == id {
+			return group, true
+		}
+	}
+	return Group{}, false
+}
+
+// groupDevice builds the virtual device for a group. Its controls come from
+// the first member, without a topic or command of their own, and reflect the
+// aggregate the group's status stores under the control's label.
+func groupDevice(config *Config, group Group) Device {
+	device := Device{
+		ID:       group.ID,
+		Name:     group.Name,
+		Category: group.Category,
+		Members:  group.memberIDs(),
+	}
+
+	var members []Device
+	for _, id := range device.Members {
+		for _, candidate := range config.Devices {
+			if candidate.ID == id {
+				members = append(members, candidate)
+			}
+		}
+	}
+	if len(members) == 0 {
+		return device
+	}
+
+	for _, control := range members[0].Controls {
+		shared := true
+		for _, member := range members[1:] {
+			if c, exists := deviceControl(member, control.Label); !exists || c.Type != control.Type {
+				shared = false
+				break
+			}
+		}
+		if !shared {
+			continue
+		}
+
+		device.Controls = append(device.Controls, Control{
+			Type:       control.Type,
+			Label:      control.Label,
+			Min:        control.Min,
+			Max:        control.Max,
+			Step:       control.Step,
+			Unit:       control.Unit,
+			ColorMode:  control.ColorMode,
+			Options:    control.Options,
+			MaxLength:  control.MaxLength,
+			Pattern:    control.Pattern,
+			StateField: strings.ReplaceAll(control.Label, ".", `\.`),
+		})
+	}
+	return device
+}
+
+func deviceControl(device Device, label string) (Control, bool) {
+	for _, control := range device.Controls {
+		if control.Label == label {
+			return control, true
+		}
+	}
+	return Control{}, false
+}
+
+func (config *Config) groupDevices() []Device {
+	devices := make([]Device, 0, len(config.Groups))
+	for _, group := range config.Groups {
+		devices = append(devices, groupDevice(config, group))
+	}
+	return devices
+}
+
+// groupStatus aggregates the member states of each group control: toggles
+// are on when any (or all) members are, numbers are averaged, and other
+// values are shown when every member agrees. It must be called with
+// statusMutex held.
+func (app *App) groupStatus(config *Config, group Group, device Device) map[string]interface{} {
+	status := make(map[string]interface{})
+	var lastUpdate time.Time
+	stale := true
+
+	for _, control := range device.Controls {
+		var states []interface{}
+		for _, memberID := range device.Members {
+			member, _ := config.findDevice(memberID)
+			c, _ := deviceControl(member, control.Label)
+			deviceStatus, exists := app.deviceStatus[memberID]
+			if !exists {
+				continue
+			}
+			if state, ok := controlState(c, deviceStatus.Status); ok {
+				states = append(states, state)
+			}
+		}
+		if len(states) == 0 {
+			continue
+		}
+
+		numeric := control.Type == "slider" || control.Type == "number" ||
+			(control.Type == "color" && control.ColorMode == "temp")
+		switch {
+		case control.Type == "toggle":
+			on := 0
+			for _, state := range states {
+				if state == true {
+					on++
+				}
+			}
+			if group.Aggregate == "all" {
+				status[control.Label] = on == len(device.Members)
+			} else {
+				status[control.Label] = on > 0
+			}
+			if _, exists := status["value"]; !exists {
+				status["value"] = fmt.Sprintf("%d of %d on", on, len(device.Members))
+			}
+		case numeric:
+			var sum float64
+			for _, state := range states {
+				sum += state.(float64)
+			}
+			status[control.Label] = sum / float64(len(states))
+		default:
+			same := len(states) == len(device.Members)
+			for _, state := range states[1:] {
+				if state != states[0] {
+					same = false
+				}
+			}
+			if same {
+				status[control.Label] = states[0]
+			}
+		}
+	}
+
+	for _, memberID := range device.Members {
+		deviceStatus, exists := app.deviceStatus[memberID]
+		if !exists {
+			continue
+		}
+		if updated, err := time.Parse(time.RFC3339, fmt.Sprint(deviceStatus.Status["lastUpdate"])); err == nil && updated.After(lastUpdate) {
+			lastUpdate = updated
+		}
+		if deviceStatus.Status["stale"] != true {
+			stale = false
+		}
+	}
+	if !lastUpdate.IsZero() {
+		status["lastUpdate"] = lastUpdate.Format(time.RFC3339)
+		if stale {
+			status["stale"] = true
+		}
+	}
+	return status
+}
+
+// updateGroups recomputes the status of every group deviceID belongs to
+// and tells clients. It must be called with statusMutex held.
+func (app *App) updateGroups(deviceID string) {
+	config := app.getConfig()
+	for _, group := range config.Groups {
+		if !listContains(group.Members, deviceID) {
+			continue
+		}
+		device := groupDevice(&config, group)
+		deviceStatus, exists := app.deviceStatus[group.ID]
+		if !exists {
+			continue
+		}
+		deviceStatus.Status = app.groupStatus(&config, group, device)
+		app.broadcastUpdate(group.ID, deviceStatus.Status)
+	}
+}
+
+// refreshGroups creates status entries for new groups and recomputes every
+// group's status, after startup and whenever the device list changes.
+func (app *App) refreshGroups() {
+	config := app.getConfig()
+
+	app.statusMutex.Lock()
+	defer app.statusMutex.Unlock()
+
+	for _, group := range config.Groups {
+		device := groupDevice(&config, group)
+		deviceStatus, exists := app.deviceStatus[group.ID]
+		if !exists {
+			deviceStatus = newDeviceStatus(device)
+			app.deviceStatus[group.ID] = deviceStatus
+			log.Printf("Added group: %s (%d members)", group.ID, len(device.Members))
+		}
+		deviceStatus.Name = device.Name
+		deviceStatus.Category = device.Category
+		deviceStatus.Controls = device.Controls
+		deviceStatus.Status = app.groupStatus(&config, group, device)
+		app.broadcastUpdate(group.ID, deviceStatus.Status)
+	}
+}
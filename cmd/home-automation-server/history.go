@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const historyDateFormat = "2006-01-02"
+
+// historyStore is an append-only on-disk log split into one JSON-lines
+// segment file per UTC day. It holds device status updates, and also backs
+// the MQTT log spool.
+type historyStore struct {
+	dir           string
+	retentionDays int
+	mutex         sync.Mutex
+	file          *os.File
+	fileDate      string
+}
+
+type historyRecord struct {
+	Time   int64                  `json:"t"` // unix milliseconds
+	Device string                 `json:"d"`
+	Status map[string]interface{} `json:"s"`
+}
+
+type HistoryPoint struct {
+	Time  string  `json:"t"`
+	Value float64 `json:"value"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+type HistorySeries struct {
+	Device string         `json:"device"`
+	Field  string         `json:"field"`
+	From   string         `json:"from"`
+	To     string         `json:"to"`
+	Step   string         `json:"step,omitempty"`
+	Points []HistoryPoint `json:"points"`
+}
+
+func newHistoryStore(dir string, retentionDays int) (*historyStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create history directory '%s': %v", dir, err)
+	}
+
+	store := &historyStore{
+		dir:           dir,
+		retentionDays: retentionDays,
+	}
+	store.prune(time.Now())
+	return store, nil
+}
+
+func (h *historyStore) segmentPath(date string) string {
+	return filepath.Join(h.dir, date+".jsonl")
+}
+
+// encodeHistoryRecord snapshots a device's status for record. It is cheap
+// enough to call with statusMutex held, unlike the write itself.
+func encodeHistoryRecord(deviceID string, status map[string]interface{}, at time.Time) []byte {
+	data, err := json.Marshal(historyRecord{
+		Time:   at.UnixNano() / int64(time.Millisecond),
+		Device: deviceID,
+		Status: status,
+	})
+	if err != nil {
+		log.Printf("History: failed to encode status for %s: %v", deviceID, err)
+		return nil
+	}
+	return data
+}
+
+// record writes a record made by encodeHistoryRecord.
+func (h *historyStore) record(deviceID string, data []byte, at time.Time) {
+	if data == nil {
+		return
+	}
+	if err := h.append(data, at); err != nil {
+		log.Printf("History: failed to write record for %s: %v", deviceID, err)
+	}
+}
+
+// append writes one encoded record to the segment for at's day.
+func (h *historyStore) append(data []byte, at time.Time) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var err error
+
+	date := at.UTC().Format(historyDateFormat)
+	if h.file == nil || h.fileDate != date {
+		if h.file != nil {
+			h.file.Close()
+			h.prune(at)
+		}
+
+		h.file, err = os.OpenFile(h.segmentPath(date), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			h.file = nil
+			return fmt.Errorf("failed to open segment for %s: %v", date, err)
+		}
+		h.fileDate = date
+	}
+
+	_, err = h.file.Write(append(data, '\n'))
+	return err
+}
+
+// prune removes segment files older than the retention period.
+func (h *historyStore) prune(now time.Time) {
+	if h.retentionDays <= 0 {
+		return
+	}
+
+	cutoff := now.UTC().AddDate(0, 0, -h.retentionDays).Format(historyDateFormat)
+	for _, date := range h.segmentDates() {
+		if date >= cutoff {
+			continue
+		}
+		path := h.segmentPath(date)
+		if err := os.Remove(path); err != nil {
+			log.Printf("History: failed to remove old segment %s: %v", path, err)
+		} else {
+			log.Printf("History: removed old segment %s", path)
+		}
+	}
+}
+
+// segmentDates lists the days that have a segment file, oldest first.
+func (h *historyStore) segmentDates() []string {
+	matches, err := filepath.Glob(filepath.Join(h.dir, "*.jsonl"))
+	if err != nil {
+		return nil
+	}
+	dates := make([]string, 0, len(matches))
+	for _, path := range matches {
+		date := filepath.Base(path)
+		dates = append(dates, date[:len(date)-len(".jsonl")])
+	}
+	sort.Strings(dates)
+	return dates
+}
+
+// sync flushes the open segment so readers see every record written so far.
+func (h *historyStore) sync() {
+	h.mutex.Lock()
+	if h.file != nil {
+		h.file.Sync()
+	}
+	h.mutex.Unlock()
+}
+
+// scanDay calls fn with each record in one day's segment, oldest first.
+func (h *historyStore) scanDay(date string, fn func(line []byte)) error {
+	file, err := os.Open(h.segmentPath(date))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// query returns the numeric values of field for deviceID between from and to,
+// averaged into buckets of step (or raw when step is zero). field is a status
+// key or, for nested values, a path as used by field mappings.
+func (h *historyStore) query(deviceID, field string, from, to time.Time, step time.Duration) ([]HistoryPoint, error) {
+	h.sync()
+
+	points := []HistoryPoint{}
+	buckets := make(map[int64]*HistoryPoint)
+	sums := make(map[int64]float64)
+
+	fromMillis := from.UnixNano() / int64(time.Millisecond)
+	toMillis := to.UnixNano() / int64(time.Millisecond)
+	stepMillis := int64(step / time.Millisecond)
+
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(to); day = day.AddDate(0, 0, 1) {
+		err := h.scanDay(day.Format(historyDateFormat), func(line []byte) {
+			var rec historyRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				return
+			}
+			if rec.Device != deviceID || rec.Time < fromMillis || rec.Time > toMillis {
+				return
+			}
+			raw, exists := rec.Status[field]
+			if !exists {
+				raw, exists = lookupFieldPath(rec.Status, field)
+			}
+			value, ok := historyValue(raw)
+			if !exists || !ok {
+				return
+			}
+
+			if stepMillis <= 0 {
+				points = append(points, HistoryPoint{
+					Time:  time.Unix(0, rec.Time*int64(time.Millisecond)).Format(time.RFC3339),
+					Value: value,
+					Min:   value,
+					Max:   value,
+					Count: 1,
+				})
+				return
+			}
+
+			key := fromMillis + (rec.Time-fromMillis)/stepMillis*stepMillis
+			bucket, exists := buckets[key]
+			if !exists {
+				bucket = &HistoryPoint{
+					Time: time.Unix(0, key*int64(time.Millisecond)).Format(time.RFC3339),
+					Min:  math.Inf(1),
+					Max:  math.Inf(-1),
+				}
+				buckets[key] = bucket
+			}
+			bucket.Count++
+			bucket.Min = math.Min(bucket.Min, value)
+			bucket.Max = math.Max(bucket.Max, value)
+			sums[key] += value
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if stepMillis <= 0 {
+		return points, nil
+	}
+
+	keys := make([]int64, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, key := range keys {
+		bucket := buckets[key]
+		bucket.Value = sums[key] / float64(bucket.Count)
+		points = append(points, *bucket)
+	}
+
+	return points, nil
+}
+
+// historyValue converts a stored status value to a number. Booleans and
+// common on/off strings map to 1/0 so switch state can be charted.
+func historyValue(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		switch value {
+		case "on", "ON", "true", "open":
+			return 1, true
+		case "off", "OFF", "false", "closed":
+			return 0, true
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// parseHistoryTime accepts RFC3339 timestamps or unix seconds.
+func parseHistoryTime(s string, fallback time.Time) (time.Time, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (app *App) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if app.history == nil {
+		http.Error(w, "History is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	deviceID := query.Get("device")
+	field := query.Get("field")
+	if deviceID == "" || field == "" {
+		http.Error(w, "device and field are required", http.StatusBadRequest)
+		return
+	}
+
+	config := app.getConfig()
+	if device, _ := config.findDevice(deviceID); !app.accessFor(r).canSeeDevice(device) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	to, err := parseHistoryTime(query.Get("to"), now)
+	if err != nil {
+		http.Error(w, "Invalid 'to' time", http.StatusBadRequest)
+		return
+	}
+	from, err := parseHistoryTime(query.Get("from"), to.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, "Invalid 'from' time", http.StatusBadRequest)
+		return
+	}
+	if from.After(to) {
+		http.Error(w, "'from' must be before 'to'", http.StatusBadRequest)
+		return
+	}
+
+	var step time.Duration
+	if s := query.Get("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil {
+			seconds, convErr := strconv.Atoi(s)
+			if convErr != nil {
+				http.Error(w, "Invalid 'step' duration", http.StatusBadRequest)
+				return
+			}
+			step = time.Duration(seconds) * time.Second
+		}
+	}
+
+	points, err := app.history.query(deviceID, field, from, to, step)
+	if err != nil {
+		log.Printf("History query failed: %v", err)
+		http.Error(w, "History query failed", http.StatusInternalServerError)
+		return
+	}
+
+	series := HistorySeries{
+		Device: deviceID,
+		Field:  field,
+		From:   from.Format(time.RFC3339),
+		To:     to.Format(time.RFC3339),
+		Points: points,
+	}
+	if step > 0 {
+		series.Step = step.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
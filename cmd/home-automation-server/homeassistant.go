@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Home Assistant MQTT discovery payloads. Only the fields we fill in are
+// declared; see https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+}
+
+type haEntity struct {
+	Name                string   `json:"name"`
+	UniqueID            string   `json:"unique_id"`
+	CommandTopic        string   `json:"command_topic,omitempty"`
+	CommandTemplate     string   `json:"command_template,omitempty"`
+	PayloadPress        string   `json:"payload_press,omitempty"`
+	PayloadOn           string   `json:"payload_on,omitempty"`
+	PayloadOff          string   `json:"payload_off,omitempty"`
+	Optimistic          bool     `json:"optimistic,omitempty"`
+	Min                 *int     `json:"min,omitempty"`
+	Max                 *int     `json:"max,omitempty"`
+	Step                float64  `json:"step,omitempty"`
+	UnitOfMeasurement   string   `json:"unit_of_measurement,omitempty"`
+	Options             []string `json:"options,omitempty"`
+	Pattern             string   `json:"pattern,omitempty"`
+	StateTopic          string   `json:"state_topic,omitempty"`
+	ValueTemplate       string   `json:"value_template,omitempty"`
+	JSONAttributesTopic string   `json:"json_attributes_topic,omitempty"`
+	Device              haDevice `json:"device"`
+}
+
+var haInvalidChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// haSlug makes an ID safe for use in discovery topics and unique IDs.
+func haSlug(s string) string {
+	return strings.Trim(haInvalidChars.ReplaceAllString(strings.ToLower(s), "_"), "_")
+}
+
+func haNodeID(config *Config) string {
+	if config.HomeAssistant.NodeID != "" {
+		return haSlug(config.HomeAssistant.NodeID)
+	}
+	if config.MQTT.ClientID != "" {
+		return haSlug(config.MQTT.ClientID)
+	}
+	return "mqtt_home_automation"
+}
+
+// haDiscoveryConfigs maps each discovery topic to its config payload. Toggles
+// become switches, sliders numbers and buttons buttons, and number, select
+// and text controls their namesakes; controls that only run a local command
+// cannot be driven over MQTT and are skipped, as are colors.
+func haDiscoveryConfigs(config *Config) (map[string]string, error) {
+	prefix := strings.TrimSuffix(config.HomeAssistant.DiscoveryPrefix, "/")
+	nodeID := haNodeID(config)
+	configs := make(map[string]string)
+
+	add := func(component, objectID string, entity haEntity) error {
+		entity.UniqueID = nodeID + "_" + objectID
+		data, err := json.Marshal(entity)
+		if err != nil {
+			return fmt.Errorf("failed to encode discovery config for %s: %v", objectID, err)
+		}
+		configs[fmt.Sprintf("%s/%s/%s/%s/config", prefix, component, nodeID, objectID)] = string(data)
+		return nil
+	}
+
+	for _, device := range config.Devices {
+		// Discovered devices already exist in whatever announced them
+		if device.Source != "" {
+			continue
+		}
+
+		haDev := haDevice{
+			Identifiers:  []string{nodeID + "_" + haSlug(device.ID)},
+			Name:         device.Name,
+			Manufacturer: "mqtt-home-automation",
+			Model:        device.Category,
+		}
+
+		// Home Assistant can't subscribe to wildcard state topics, so only
+		// exact status topics become sensors
+		hasStatus := false
+		for _, statusTopic := range device.StatusTopics {
+			if strings.ContainsAny(statusTopic.Topic, "+#") {
+				continue
+			}
+			var err error
+			if statusTopic.Field != "" {
+				err = add("sensor", haSlug(device.ID)+"_"+haSlug(statusTopic.Field), haEntity{
+					Name:       statusTopic.Field,
+					StateTopic: statusTopic.Topic,
+					Device:     haDev,
+				})
+			} else if !hasStatus {
+				hasStatus = true
+				err = add("sensor", haSlug(device.ID)+"_status", haEntity{
+					Name:                "Status",
+					StateTopic:          statusTopic.Topic,
+					ValueTemplate:       "{{ value_json.value | default(value) }}",
+					JSONAttributesTopic: statusTopic.Topic,
+					Device:              haDev,
+				})
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, control := range device.Controls {
+			if control.Topic == "" {
+				continue
+			}
+
+			objectID := haSlug(device.ID) + "_" + haSlug(control.Label)
+			entity := haEntity{
+				Name:         control.Label,
+				CommandTopic: control.Topic,
+				Device:       haDev,
+			}
+
+			// Home Assistant publishes to the command topic itself, so
+			// payload templates are rendered here without a device status
+			render := func(value interface{}) (string, error) {
+				return renderControlPayload(control, controlPayloadData{
+					Value:     value,
+					Device:    device.ID,
+					Status:    map[string]interface{}{},
+					Timestamp: time.Now(),
+				})
+			}
+
+			var component string
+			var err error
+			switch control.Type {
+			case "toggle":
+				var on, off string
+				if on, err = render(true); err == nil {
+					off, err = render(false)
+				}
+				if err != nil {
+					break
+				}
+				if on == off {
+					if on == "" {
+						log.Printf("Home Assistant discovery: skipping toggle '%s' on %s, its payload is empty", control.Label, device.ID)
+						continue
+					}
+					// A fixed payload such as TOGGLE flips the device
+					// rather than setting a state, so it is a button
+					component = "button"
+					entity.PayloadPress = on
+				} else {
+					// No state topic is announced, so Home Assistant
+					// tracks the state itself
+					component = "switch"
+					entity.PayloadOn = on
+					entity.PayloadOff = off
+					entity.Optimistic = true
+				}
+			case "slider":
+				if control.Payload != "" {
+					// A Go template cannot be turned into a command_template
+					continue
+				}
+				component = "number"
+				min, max := control.Min, control.Max
+				entity.Min = &min
+				entity.Max = &max
+				entity.CommandTemplate = fmt.Sprintf(`{"%s": {{ value }}}`, strings.ToLower(control.Label))
+			case "number", "select", "text":
+				if control.Payload != "" {
+					continue
+				}
+				// Home Assistant sends the plain value, as our defaults do
+				component = control.Type
+				switch control.Type {
+				case "number":
+					if boundedNumber(control) {
+						min, max := control.Min, control.Max
+						entity.Min = &min
+						entity.Max = &max
+					}
+					entity.Step = control.Step
+					entity.UnitOfMeasurement = control.Unit
+				case "select":
+					for _, option := range control.Options {
+						entity.Options = append(entity.Options, option.Value)
+					}
+				case "text":
+					if control.MaxLength > 0 {
+						max := control.MaxLength
+						entity.Max = &max
+					}
+					entity.Pattern = control.Pattern
+				}
+			case "button":
+				component = "button"
+				entity.PayloadPress, err = render(nil)
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("device '%s' control '%s': %v", device.ID, control.Label, err)
+			}
+
+			if err := add(component, objectID, entity); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return configs, nil
+}
+
+// publishDiscovery publishes retained discovery configs for every device and
+// clears the ones that are no longer in the config. It runs on each connect
+// and after config reloads.
+func (app *App) publishDiscovery() {
+	if app.mqttClient == nil || !app.mqttClient.IsConnected() {
+		return
+	}
+
+	config := app.getConfig()
+	configs := make(map[string]string)
+	if config.HomeAssistant.Enabled {
+		var err error
+		if configs, err = haDiscoveryConfigs(&config); err != nil {
+			log.Printf("Home Assistant discovery: %v", err)
+			return
+		}
+	}
+
+	app.haMutex.Lock()
+	oldTopics := app.haTopics
+	app.haTopics = make(map[string]bool, len(configs))
+	for topic := range configs {
+		app.haTopics[topic] = true
+	}
+	app.haMutex.Unlock()
+
+	for topic := range oldTopics {
+		if _, exists := configs[topic]; !exists {
+			app.clearDiscoveryTopic(topic)
+		}
+	}
+	for topic, payload := range configs {
+		if err := app.publishMQTT(topic, payload, true); err != nil {
+			log.Printf("Home Assistant discovery: failed to publish %s: %v", topic, err)
+		}
+	}
+
+	if !config.HomeAssistant.Enabled {
+		return
+	}
+	log.Printf("Home Assistant discovery: published %d entities under %s", len(configs), config.HomeAssistant.DiscoveryPrefix)
+
+	// Retained configs left over from devices removed while the server was
+	// down are delivered on subscribe and cleared by the handler
+	pattern := fmt.Sprintf("%s/+/%s/+/config", strings.TrimSuffix(config.HomeAssistant.DiscoveryPrefix, "/"), haNodeID(&config))
+	token := app.mqttClient.Subscribe(pattern, 1, app.onDiscoveryMessage)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Home Assistant discovery: failed to subscribe to %s: %v", pattern, token.Error())
+	}
+}
+
+func (app *App) onDiscoveryMessage(client mqtt.Client, msg mqtt.Message) {
+	if !msg.Retained() || len(msg.Payload()) == 0 {
+		return
+	}
+
+	app.haMutex.Lock()
+	current := app.haTopics[msg.Topic()]
+	app.haMutex.Unlock()
+
+	// Publishing waits for the broker's ack, which can't arrive while this
+	// message handler is still running
+	if !current && app.getConfig().HomeAssistant.Enabled {
+		go app.clearDiscoveryTopic(msg.Topic())
+	}
+}
+
+// clearDiscoveryTopic removes an entity from Home Assistant by replacing its
+// retained config with an empty message.
+func (app *App) clearDiscoveryTopic(topic string) {
+	if err := app.publishMQTT(topic, "", true); err != nil {
+		log.Printf("Home Assistant discovery: failed to remove %s: %v", topic, err)
+		return
+	}
+	log.Printf("Home Assistant discovery: removed %s", topic)
+}
@@ -1,24 +1,209 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	uuid "github.com/google/uuid"
 )
 
-func (app *App) executeLocalCommand(command string) {
-	log.Printf("Executing local command: %s", command)
+// Output beyond this many bytes per stream is dropped from command results
+const maxCommandOutput = 4096
+
+// commandLogRing holds the most recent command results, overwriting the
+// oldest once full. The zero value is empty and grows to the size given to
+// add.
+type commandLogRing struct {
+	results []CommandResult
+	start   int // index of the oldest result
+	count   int
+}
+
+// add stores result, first resizing the ring if size has changed.
+func (r *commandLogRing) add(result CommandResult, size int) {
+	if len(r.results) != size {
+		r.resize(size)
+	}
+	if r.count < len(r.results) {
+		r.results[(r.start+r.count)%len(r.results)] = result
+		r.count++
+		return
+	}
+	r.results[r.start] = result
+	r.start = (r.start + 1) % len(r.results)
+}
+
+// resize keeps the newest results that fit in size.
+func (r *commandLogRing) resize(size int) {
+	results := make([]CommandResult, size)
+	kept := r.count
+	if kept > size {
+		kept = size
+	}
+	for i := 0; i < kept; i++ {
+		results[i] = r.results[(r.start+r.count-kept+i)%len(r.results)]
+	}
+	r.results = results
+	r.start = 0
+	r.count = kept
+}
+
+// replace overwrites the result with the same ID, reporting whether there
+// was one.
+func (r *commandLogRing) replace(result CommandResult) bool {
+	for i := 0; i < r.count; i++ {
+		index := (r.start + i) % len(r.results)
+		if r.results[index].ID == result.ID {
+			r.results[index] = result
+			return true
+		}
+	}
+	return false
+}
+
+// each calls fn with results newest first.
+func (r *commandLogRing) each(fn func(result CommandResult)) {
+	for i := r.count - 1; i >= 0; i-- {
+		fn(r.results[(r.start+i)%len(r.results)])
+	}
+}
+
+// startLocalCommand runs command in the background and returns the ID under
+// which its result is reported.
+func (app *App) startLocalCommand(deviceID, command, source string) string {
+	result := CommandResult{
+		ID:       uuid.New().String(),
+		Command:  command,
+		Device:   deviceID,
+		Source:   source,
+		Started:  time.Now().Format(time.RFC3339),
+		Running:  true,
+		ExitCode: -1,
+	}
+	app.recordCommandResult(result)
+
+	go app.executeLocalCommand(result)
+	return result.ID
+}
+
+func (app *App) executeLocalCommand(result CommandResult) {
+	log.Printf("Executing local command: %s", result.Command)
+
+	timeout := time.Duration(app.getConfig().CommandTimeout) * time.Second
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", result.Command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Run in its own process group so a timeout also kills anything the
+	// shell started, which would otherwise keep the output pipes open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	var timedOut int32
+	start := time.Now()
+	err := cmd.Start()
+	if err == nil {
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		err = cmd.Wait()
+		timer.Stop()
+	}
 
-	cmd := exec.Command("sh", "-c", command)
-	output, err := cmd.CombinedOutput()
+	result.Running = false
+	result.DurationMs = time.Since(start).Milliseconds()
+	result.Stdout = truncateOutput(stdout.String())
+	result.Stderr = truncateOutput(stderr.String())
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if atomic.LoadInt32(&timedOut) == 1 {
+		result.TimedOut = true
+		result.Error = fmt.Sprintf("timed out after %s", timeout)
+	} else if err != nil {
+		result.Error = err.Error()
+	}
 
-	if err != nil {
-		log.Printf("Local command failed: %v, Output: %s", err, string(output))
+	if result.Error != "" {
+		log.Printf("Local command failed: %s, Output: %s%s", result.Error, result.Stdout, result.Stderr)
 	} else {
-		log.Printf("Local command executed successfully. Output: %s", string(output))
+		log.Printf("Local command executed successfully. Output: %s", result.Stdout)
+	}
+
+	app.recordCommandResult(result)
+	app.broadcastCommandResult(result)
+}
+
+func truncateOutput(output string) string {
+	if len(output) > maxCommandOutput {
+		return output[:maxCommandOutput] + "\n[output truncated]"
+	}
+	return output
+}
+
+// recordCommandResult adds result to the command log, or replaces the entry
+// with the same ID once a running command finishes.
+func (app *App) recordCommandResult(result CommandResult) {
+	size := app.getConfig().CommandLogSize
+
+	app.commandMutex.Lock()
+	defer app.commandMutex.Unlock()
+
+	if !app.commandLog.replace(result) {
+		app.commandLog.add(result, size)
+	}
+}
+
+// canSeeCommand limits device commands to users who can see the device;
+// commands run by rules have no device and are shown to admins only.
+func (a *access) canSeeCommand(config *Config, result CommandResult) bool {
+	if result.Device == "" {
+		return a.isAdmin()
 	}
+	device, _ := config.findDevice(result.Device)
+	return a.canSeeDevice(device)
+}
+
+func (app *App) broadcastCommandResult(result CommandResult) {
+	message := WebSocketMessage{
+		Type:     "command_result",
+		DeviceID: result.Device,
+		Data:     result,
+	}
+
+	config := app.getConfig()
+	app.broadcastTo(message, func(a *access) bool {
+		return a.canSeeCommand(&config, result)
+	})
+}
+
+func (app *App) handleCommands(w http.ResponseWriter, r *http.Request) {
+	config := app.getConfig()
+	userAccess := app.accessFor(r)
+
+	app.commandMutex.RLock()
+	defer app.commandMutex.RUnlock()
+
+	results := make([]CommandResult, 0, app.commandLog.count)
+	app.commandLog.each(func(result CommandResult) {
+		if userAccess.canSeeCommand(&config, result) {
+			results = append(results, result)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
 }
 
 func (app *App) getSystemStats() SystemStats {
@@ -69,5 +254,8 @@ func (app *App) getSystemStats() SystemStats {
 		}
 	}
 
+	stats.WSClients = app.wsClientCount()
+	stats.WSDropped = atomic.LoadUint64(&app.wsDropped)
+
 	return stats
 }
@@ -14,15 +14,28 @@ func main() {
 	suppressTimestamp := flag.Bool("no-timestamp", false, "Suppress timestamps in log output")
 	webDir := flag.String("webdir", ".", "Parent directory containing 'static' and 'templates' subdirectories")
 	enableWildcard := flag.Bool("log-all-mqtt", false, "Log all MQTT messages using wildcard subscription")
+	noWatch := flag.Bool("no-watch", false, "Disable automatic reload when the config file or templates change")
+	hashPassword := flag.Bool("hash-password", false, "Read a password from stdin, print its bcrypt hash and exit")
 	flag.Parse()
 
+	if *hashPassword {
+		if err := printPasswordHash(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	app := &App{
 		deviceStatus: make(map[string]*DeviceStatus),
-		wsClients:    make(map[*websocket.Conn]bool),
-		wsUpgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
-		},
-		webDir: *webDir,
+		wsClients:    make(map[*wsClient]bool),
+		webDir:       *webDir,
+		ruleStates:   make(map[string]*ruleState),
+		schedules:    make(map[string]*scheduleState),
+		sessions:     make(map[string]*session),
+		logAllMQTT:   *enableWildcard,
+	}
+	app.wsUpgrader = websocket.Upgrader{
+		CheckOrigin: app.checkOrigin,
 	}
 
 	// Load configuration
@@ -35,11 +48,49 @@ func main() {
 		log.SetFlags(0) // Remove all flags including timestamp
 	}
 
+	// Open the on-disk status history if configured
+	if app.config.History.Dir != "" {
+		history, err := newHistoryStore(app.config.History.Dir, app.config.History.RetentionDays)
+		if err != nil {
+			log.Fatal("Failed to open history store:", err)
+		}
+		app.history = history
+		log.Printf("Recording device history in: %s", app.config.History.Dir)
+	}
+
+	// Spool the MQTT log to disk if configured
+	if app.config.MQTTLogSpool.Dir != "" {
+		spool, err := newHistoryStore(app.config.MQTTLogSpool.Dir, app.config.MQTTLogSpool.RetentionDays)
+		if err != nil {
+			log.Fatal("Failed to open MQTT log spool:", err)
+		}
+		app.mqttSpool = spool
+		log.Printf("Spooling MQTT log to: %s", app.config.MQTTLogSpool.Dir)
+	}
+
+	if app.config.TopicTree.Enabled {
+		app.topicTree = newTopicTree(app.config.TopicTree.MaxTopics)
+		log.Printf("Topic tree enabled for up to %d topics", app.config.TopicTree.MaxTopics)
+	}
+
+	if app.config.Discovery.Enabled {
+		app.discovery = newDiscoveryState()
+		go app.applyDiscoveryChanges()
+		log.Printf("Device discovery enabled for: %s", app.config.Discovery.Sources)
+	}
+
 	// Set default MQTT retry values if not specified
 	if app.config.MQTT.RetryInterval == 0 {
 		app.config.MQTT.RetryInterval = 5 // default 5 seconds
 	}
 
+	// Initialize device status and restore the last saved state before any
+	// status messages can arrive
+	app.initializeDeviceStatus()
+	app.restoreState()
+	app.refreshGroups()
+	app.loadPublishConsole()
+
 	// Connect to MQTT with retry logic
 	if err := app.connectMQTTWithRetry(); err != nil {
 		log.Fatal("Failed to connect to MQTT after all retries:", err)
@@ -50,24 +101,43 @@ func main() {
 		log.Fatal("Failed to load templates:", err)
 	}
 
-	// Initialize device status
-	app.initializeDeviceStatus()
-
 	// Subscribe to status topics
 	app.subscribeToStatusTopics()
 
-	// Optionally subscribe to all messages for logging
-	if *enableWildcard {
-		app.subscribeToAllMessages()
+	// Start time-based schedules
+	app.startScheduler()
+
+	// Mark devices unavailable when their status goes quiet
+	app.startAvailabilityChecker()
+
+	// End sessions as they expire, closing their WebSocket clients
+	app.startSessionExpiry()
+
+	// Reload config and templates when they change on disk
+	if !*noWatch {
+		app.startFileWatcher()
+		log.Println("File watching enabled - configuration will auto-reload on changes")
 	}
 
 	// Setup HTTP routes
-	http.HandleFunc("/", app.handleIndex)
-	http.HandleFunc("/ws", app.handleWebSocket)
-	http.HandleFunc("/api/control", app.handleControl)
-	http.HandleFunc("/api/status", app.handleStatus)
-	http.HandleFunc("/api/system-stats", app.handleSystemStats)
-	http.HandleFunc("/api/mqtt-log", app.handleMQTTLog)
+	http.HandleFunc("/login", app.handleLogin)
+	http.HandleFunc("/logout", app.requireAuth(app.handleLogout))
+	http.HandleFunc("/", app.requireAuth(app.handleIndex))
+	http.HandleFunc("/ws", app.requireAuth(app.handleWebSocket))
+	http.HandleFunc("/api/control", app.requireAuth(app.handleControl))
+	http.HandleFunc("/api/publish", app.requireAuth(app.handlePublish))
+	http.HandleFunc("/api/publish/snippets", app.requireAuth(app.handlePublishSnippets))
+	http.HandleFunc("/api/status", app.requireAuth(app.handleStatus))
+	http.HandleFunc("/api/system-stats", app.requireAuth(app.handleSystemStats))
+	http.HandleFunc("/api/mqtt-log", app.requireAuth(app.handleMQTTLog))
+	http.HandleFunc("/api/commands", app.requireAuth(app.handleCommands))
+	http.HandleFunc("/api/schedules", app.requireAuth(app.handleSchedules))
+	http.HandleFunc("/api/scenes", app.requireAuth(app.handleScenes))
+	http.HandleFunc("/api/scenes/capture", app.requireAuth(app.handleSceneCapture))
+	http.HandleFunc("/api/history", app.requireAuth(app.handleHistory))
+	http.HandleFunc("/api/topics", app.requireAuth(app.handleTopics))
+	http.HandleFunc("/api/discovered", app.requireAuth(app.handleDiscovered))
+	http.HandleFunc("/api/discovered/promote", app.requireAuth(app.handlePromote))
 
 	// Serve static files
 	staticDir := filepath.Join(app.webDir, "static")
@@ -34,12 +34,29 @@ func (app *App) connectMQTTWithRetry() error {
 
 func (app *App) connectMQTT() error {
 	opts := mqtt.NewClientOptions()
-	broker := fmt.Sprintf("tcp://%s:%d", app.config.MQTT.Broker, app.config.MQTT.Port)
+	broker, err := mqttBrokerURL(app.config.MQTT)
+	if err != nil {
+		return err
+	}
 	opts.AddBroker(broker)
+
+	tlsConfig, err := mqttTLSConfig(app.config.MQTT)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
 	opts.SetClientID(app.config.MQTT.ClientID)
 	opts.SetUsername(app.config.MQTT.Username)
 	opts.SetPassword(app.config.MQTT.Password)
 
+	if topic := app.config.MQTT.AvailabilityTopic; topic != "" {
+		_, offline := availabilityPayloads(app.config.MQTT.PayloadOnline, app.config.MQTT.PayloadOffline)
+		opts.SetWill(topic, offline, 1, true)
+	}
+
 	// Set connection timeout
 	opts.SetConnectTimeout(10 * time.Second)
 	opts.SetKeepAlive(30 * time.Second)
@@ -60,6 +77,13 @@ func (app *App) connectMQTT() error {
 		log.Println("Connected to MQTT broker")
 		// Resubscribe to status topics after reconnection
 		app.subscribeToStatusTopics()
+		app.subscribeToAvailabilityTopics()
+		go app.publishServerAvailability()
+		// Ask devices for a fresh status
+		go app.requestDeviceStatus()
+		go app.publishDiscovery()
+		go app.subscribeDiscovery()
+		go app.subscribeToAllMessages()
 	})
 
 	// Enable automatic reconnection
@@ -76,6 +100,44 @@ func (app *App) connectMQTT() error {
 	return nil
 }
 
+// publishMQTT publishes a message at QoS 1 and records it in the MQTT log as
+// outgoing.
+func (app *App) publishMQTT(topic, payload string, retain bool) error {
+	return app.publishMQTTQoS(topic, payload, 1, retain)
+}
+
+func (app *App) publishMQTTQoS(topic, payload string, qos byte, retain bool) error {
+	token := app.mqttClient.Publish(topic, qos, retain, payload)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	if retain && app.topicTree != nil {
+		// The broker clears the retain flag on the copy it sends back to us
+		app.topicTree.record(topic, payload, qos, true, time.Now())
+	}
+	app.logMQTTPublish(topic, payload, qos, retain)
+	return nil
+}
+
+// triggerControl performs a configured control the same way a button press
+// in the dashboard does. It returns the ID of the started local command, if
+// the control has one.
+func (app *App) triggerControl(deviceID string, control Control, payload, source string) (string, error) {
+	commandID := ""
+	if control.LocalCommand != "" {
+		commandID = app.startLocalCommand(deviceID, control.LocalCommand, source)
+	}
+
+	if control.Topic != "" {
+		if err := app.publishMQTT(control.Topic, payload, false); err != nil {
+			return commandID, err
+		}
+	}
+
+	return commandID, nil
+}
+
 func (app *App) reconnectMQTT() {
 	retryCount := 0
 
@@ -83,7 +145,7 @@ func (app *App) reconnectMQTT() {
 		retryCount++
 		log.Printf("MQTT reconnection attempt %d...", retryCount)
 
-		time.Sleep(time.Duration(app.config.MQTT.RetryInterval) * time.Second)
+		time.Sleep(time.Duration(app.getConfig().MQTT.RetryInterval) * time.Second)
 
 		// The MQTT client will handle reconnection automatically
 		// We just need to wait and log the attempts
@@ -98,49 +160,50 @@ func (app *App) initializeDeviceStatus() {
 	app.statusMutex.Lock()
 	defer app.statusMutex.Unlock()
 
-	for _, device := range app.config.Devices {
-		app.deviceStatus[device.ID] = &DeviceStatus{
-			ID:       device.ID,
-			Name:     device.Name,
-			Category: device.Category,
-			Status:   make(map[string]interface{}),
-			Controls: device.Controls,
-		}
+	for _, device := range app.getConfig().Devices {
+		app.deviceStatus[device.ID] = newDeviceStatus(device)
 	}
 }
 
-func (app *App) subscribeToAllMessages() {
-	// Subscribe to all topics with wildcard
-	token := app.mqttClient.Subscribe("#", 0, func(client mqtt.Client, msg mqtt.Message) {
-		app.addMQTTLogEntry(msg.Topic(), string(msg.Payload()))
-	})
-
-	if token.Wait() && token.Error() != nil {
-		log.Printf("Failed to subscribe to wildcard topic: %v", token.Error())
-	} else {
-		log.Printf("Subscribed to wildcard topic for MQTT logging")
+func newDeviceStatus(device Device) *DeviceStatus {
+	return &DeviceStatus{
+		ID:        device.ID,
+		Name:      device.Name,
+		Category:  device.Category,
+		Status:    make(map[string]interface{}),
+		Units:     fieldUnits(device),
+		Controls:  device.Controls,
+		Available: true,
+		lastSeen:  time.Now(),
 	}
 }
 
 func (app *App) subscribeToStatusTopics() {
-	for _, device := range app.config.Devices {
-		if device.StatusTopic != "" {
-			topic := device.StatusTopic
-			deviceID := device.ID
-
-			token := app.mqttClient.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
-				// Add MQTT logging here
-				app.addMQTTLogEntry(msg.Topic(), string(msg.Payload()))
-				// Handle the status update
-				app.handleStatusUpdate(deviceID, msg.Topic(), string(msg.Payload()))
-			})
-
-			if token.Wait() && token.Error() != nil {
-				log.Printf("Failed to subscribe to %s: %v", topic, token.Error())
-			} else {
-				log.Printf("Subscribed to status topic: %s for device: %s", topic, deviceID)
-			}
+	for filter := range statusTopicOwners(app.getConfig().Devices) {
+		app.subscribeToStatusTopic(filter)
+	}
+}
+
+// subscribeToStatusTopic subscribes to a status topic filter. Messages are
+// routed by topic against the current device list rather than by the
+// subscription they arrived on, since the client hands a message to every
+// matching filter's handler; only the handler of the winning filter acts.
+func (app *App) subscribeToStatusTopic(filter string) {
+	token := app.mqttClient.Subscribe(filter, 1, func(client mqtt.Client, msg mqtt.Message) {
+		binding, found := resolveStatusTopic(app.getConfig().Devices, msg.Topic())
+		if !found || binding.filter.Topic != filter {
+			return
 		}
+		// Add MQTT logging here
+		app.logMQTTMessage(msg)
+		// Handle the status update
+		app.handleStatusUpdate(binding, msg.Topic(), string(msg.Payload()), msg.Retained())
+	})
+
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Failed to subscribe to %s: %v", filter, token.Error())
+	} else {
+		log.Printf("Subscribed to status topic: %s", filter)
 	}
 }
 
@@ -149,89 +212,91 @@ func (app *App) onMQTTMessage(client mqtt.Client, msg mqtt.Message) {
 	payload := string(msg.Payload())
 
 	log.Printf("Received MQTT message on topic %s: %s", topic, payload)
-	app.addMQTTLogEntry(topic, payload)
+	app.logMQTTMessage(msg)
 }
 
-func (app *App) handleStatusUpdate(deviceID, topic, payload string) {
+func (app *App) handleStatusUpdate(binding statusBinding, topic, payload string, retained bool) {
+	deviceID := binding.deviceID
+	config := app.getConfig()
+	device, _ := config.findDevice(deviceID)
+
+	var historyData []byte
+	var historyTime time.Time
+
 	app.statusMutex.Lock()
-	defer app.statusMutex.Unlock()
+	deviceStatus, exists := app.deviceStatus[deviceID]
+	if exists && retained {
+		// Resubscribing replays retained messages we have already applied
+		if last, seen := deviceStatus.lastPayloads[topic]; seen && last == payload {
+			app.statusMutex.Unlock()
+			return
+		}
+	}
+	if exists {
+		if deviceStatus.lastPayloads == nil {
+			deviceStatus.lastPayloads = make(map[string]string)
+		}
+		deviceStatus.lastPayloads[topic] = payload
 
-	if deviceStatus, exists := app.deviceStatus[deviceID]; exists {
 		// Try to parse as JSON, fallback to string
-		var jsonData interface{}
-		if err := json.Unmarshal([]byte(payload), &jsonData); err != nil {
-			deviceStatus.Status["value"] = payload
+		var data interface{}
+		if err := json.Unmarshal([]byte(payload), &data); err != nil {
+			data = payload
+		}
+
+		if binding.filter.Field != "" {
+			setTopicField(device, binding.filter.Field, data, deviceStatus.Status)
+		} else if len(device.Fields) > 0 {
+			applyFieldMappings(device.Fields, data, deviceStatus.Status)
+		} else if object, ok := data.(map[string]interface{}); ok {
+			// Other topics may report different keys, so merge
+			for key, value := range object {
+				deviceStatus.Status[key] = value
+			}
 		} else {
-			deviceStatus.Status = jsonData.(map[string]interface{})
+			// Arrays, numbers and plain text are kept whole
+			deviceStatus.Status["value"] = data
 		}
 
-		deviceStatus.Status["lastUpdate"] = time.Now().Format(time.RFC3339)
+		delete(deviceStatus.Status, "stale")
+		now := time.Now()
+		deviceStatus.Status["lastUpdate"] = now.Format(time.RFC3339)
+		deviceStatus.lastSeen = now
+
+		// Encode the history record now but write it once the lock is
+		// released, so a slow disk doesn't hold up status readers
+		if app.history != nil {
+			historyData = encodeHistoryRecord(deviceID, deviceStatus.Status, now)
+			historyTime = now
+		}
 
 		// Broadcast update to WebSocket clients
 		app.broadcastUpdate(deviceID, deviceStatus.Status)
+		app.updateAvailability(device, deviceStatus, now)
+		app.updateGroups(deviceID)
+	}
+	app.statusMutex.Unlock()
+
+	if historyData != nil {
+		app.history.record(deviceID, historyData, historyTime)
+	}
+	if exists {
+		app.scheduleStateSave()
+		app.evaluateRules(deviceID)
 	}
 }
 
 func (app *App) broadcastUpdate(deviceID string, status map[string]interface{}) {
-	app.wsMutex.RLock()
-	defer app.wsMutex.RUnlock()
+	config := app.getConfig()
+	device, _ := config.findDevice(deviceID)
 
 	message := WebSocketMessage{
 		Type:     "status_update",
 		DeviceID: deviceID,
 		Data:     status,
+		Controls: controlStates(device, status),
 	}
-
-	for client := range app.wsClients {
-		if err := client.WriteJSON(message); err != nil {
-			log.Printf("Error sending WebSocket message: %v", err)
-			client.Close()
-			delete(app.wsClients, client)
-		}
-	}
-}
-
-func (app *App) addMQTTLogEntry(topic, payload string) {
-	app.mqttLogMutex.Lock()
-	defer app.mqttLogMutex.Unlock()
-
-	// Create new log entry
-	entry := MQTTLogEntry{
-		Timestamp: time.Now().Format("15:04:05"),
-		Topic:     topic,
-		Payload:   payload,
-	}
-
-	// Add to beginning of slice
-	app.mqttLog = append([]MQTTLogEntry{entry}, app.mqttLog...)
-
-	// Trim to max size
-	maxSize := app.config.MQTTLogSize
-	if maxSize <= 0 {
-		maxSize = 20 // default
-	}
-	if len(app.mqttLog) > maxSize {
-		app.mqttLog = app.mqttLog[:maxSize]
-	}
-
-	// Broadcast to WebSocket clients
-	app.broadcastMQTTLog(entry)
-}
-
-func (app *App) broadcastMQTTLog(entry MQTTLogEntry) {
-	app.wsMutex.RLock()
-	defer app.wsMutex.RUnlock()
-
-	message := WebSocketMessage{
-		Type: "mqtt_log",
-		Data: entry,
-	}
-
-	for client := range app.wsClients {
-		if err := client.WriteJSON(message); err != nil {
-			log.Printf("Error sending MQTT log WebSocket message: %v", err)
-			client.Close()
-			delete(app.wsClients, client)
-		}
-	}
+	app.broadcastTo(message, func(a *access) bool {
+		return a.canSeeDevice(device)
+	})
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttLogDefaultLimit = 100
+	mqttLogMaxLimit     = 1000
+)
+
+// mqttLogRing holds the most recent MQTT log entries, overwriting the oldest
+// once full. The zero value is empty and grows to the size given to add.
+type mqttLogRing struct {
+	entries []MQTTLogEntry
+	start   int // index of the oldest entry
+	count   int
+}
+
+// add stores entry, first resizing the ring if size has changed.
+func (r *mqttLogRing) add(entry MQTTLogEntry, size int) {
+	if len(r.entries) != size {
+		r.resize(size)
+	}
+	if r.count < len(r.entries) {
+		r.entries[(r.start+r.count)%len(r.entries)] = entry
+		r.count++
+		return
+	}
+	r.entries[r.start] = entry
+	r.start = (r.start + 1) % len(r.entries)
+}
+
+// resize keeps the newest entries that fit in size.
+func (r *mqttLogRing) resize(size int) {
+	entries := make([]MQTTLogEntry, size)
+	kept := r.count
+	if kept > size {
+		kept = size
+	}
+	for i := 0; i < kept; i++ {
+		entries[i] = r.entries[(r.start+r.count-kept+i)%len(r.entries)]
+	}
+	r.entries = entries
+	r.start = 0
+	r.count = kept
+}
+
+// each calls fn with entries newest first until fn returns false.
+func (r *mqttLogRing) each(fn func(entry MQTTLogEntry) bool) {
+	for i := r.count - 1; i >= 0; i-- {
+		if !fn(r.entries[(r.start+i)%len(r.entries)]) {
+			return
+		}
+	}
+}
+
+// logMQTTMessage records a received message in the MQTT log.
+func (app *App) logMQTTMessage(msg mqtt.Message) {
+	app.addMQTTLogEntry(MQTTLogEntry{
+		Topic:     msg.Topic(),
+		Payload:   string(msg.Payload()),
+		QoS:       msg.Qos(),
+		Retain:    msg.Retained(),
+		Direction: "in",
+	})
+}
+
+// logMQTTPublish records a message this server published in the MQTT log.
+func (app *App) logMQTTPublish(topic, payload string, qos byte, retain bool) {
+	app.addMQTTLogEntry(MQTTLogEntry{
+		Topic:     topic,
+		Payload:   payload,
+		QoS:       qos,
+		Retain:    retain,
+		Direction: "out",
+	})
+}
+
+func (app *App) addMQTTLogEntry(entry MQTTLogEntry) {
+	entry.Timestamp = time.Now()
+	entry.Size = len(entry.Payload)
+
+	app.mqttLogMutex.Lock()
+	app.mqttLog.add(entry, app.getConfig().MQTTLogSize)
+	app.mqttLogMutex.Unlock()
+
+	if app.mqttSpool != nil {
+		if data, err := json.Marshal(entry); err == nil {
+			if err := app.mqttSpool.append(data, entry.Timestamp); err != nil {
+				log.Printf("MQTT log spool: failed to write entry for %s: %v", entry.Topic, err)
+			}
+		}
+	}
+
+	// Broadcast to WebSocket clients
+	app.broadcastMQTTLog(entry)
+}
+
+func (app *App) broadcastMQTTLog(entry MQTTLogEntry) {
+	message := WebSocketMessage{
+		Type: "mqtt_log",
+		Data: entry,
+	}
+
+	config := app.getConfig()
+	app.broadcastTo(message, func(a *access) bool {
+		return a.canSeeTopic(&config, entry.Topic)
+	})
+}
+
+// mqttLogQuery selects MQTT log entries. Results are newest first; to page
+// back, pass the timestamp of the last entry received as before.
+type mqttLogQuery struct {
+	topic     string         // MQTT topic filter, empty for all topics
+	search    *regexp.Regexp // matched against the payload
+	direction string         // "in", "out" or empty for both
+	from, to  time.Time      // inclusive; zero means unbounded
+	before    time.Time      // exclusive; zero means unbounded
+	limit     int
+}
+
+func parseMQTTLogQuery(values url.Values) (mqttLogQuery, error) {
+	q := mqttLogQuery{
+		topic:     values.Get("topic"),
+		direction: values.Get("direction"),
+		limit:     mqttLogDefaultLimit,
+	}
+
+	if q.topic != "" {
+		if err := validateTopicFilter(q.topic); err != nil {
+			return q, fmt.Errorf("invalid 'topic': %v", err)
+		}
+	}
+	if s := values.Get("search"); s != "" {
+		search, err := regexp.Compile(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid 'search': %v", err)
+		}
+		q.search = search
+	}
+	if q.direction != "" && q.direction != "in" && q.direction != "out" {
+		return q, fmt.Errorf("'direction' must be 'in' or 'out'")
+	}
+
+	var err error
+	for _, bound := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &q.from}, {"to", &q.to}, {"before", &q.before}} {
+		if *bound.value, err = parseHistoryTime(values.Get(bound.name), time.Time{}); err != nil {
+			return q, fmt.Errorf("invalid '%s' time", bound.name)
+		}
+	}
+
+	if s := values.Get("limit"); s != "" {
+		if q.limit, err = strconv.Atoi(s); err != nil || q.limit <= 0 {
+			return q, fmt.Errorf("invalid 'limit'")
+		}
+		if q.limit > mqttLogMaxLimit {
+			q.limit = mqttLogMaxLimit
+		}
+	}
+	return q, nil
+}
+
+func (q *mqttLogQuery) matches(entry MQTTLogEntry) bool {
+	switch {
+	case !q.from.IsZero() && entry.Timestamp.Before(q.from):
+		return false
+	case !q.to.IsZero() && entry.Timestamp.After(q.to):
+		return false
+	case !q.before.IsZero() && !entry.Timestamp.Before(q.before):
+		return false
+	case q.direction != "" && entry.Direction != q.direction:
+		return false
+	case q.topic != "" && !topicMatches(q.topic, entry.Topic):
+		return false
+	case q.search != nil && !q.search.MatchString(entry.Payload):
+		return false
+	}
+	return true
+}
+
+// queryMQTTLog returns the entries matching q that visible allows, reading
+// the in-memory log first and then the spool for anything older.
+func (app *App) queryMQTTLog(q mqttLogQuery, visible func(topic string) bool) ([]MQTTLogEntry, error) {
+	entries := make([]MQTTLogEntry, 0)
+	oldest := time.Now()
+
+	app.mqttLogMutex.RLock()
+	app.mqttLog.each(func(entry MQTTLogEntry) bool {
+		oldest = entry.Timestamp
+		if q.matches(entry) && visible(entry.Topic) {
+			entries = append(entries, entry)
+		}
+		return len(entries) < q.limit
+	})
+	app.mqttLogMutex.RUnlock()
+
+	if len(entries) >= q.limit || app.mqttSpool == nil {
+		return entries, nil
+	}
+	older, err := app.queryMQTTSpool(q, oldest, q.limit-len(entries), visible)
+	return append(entries, older...), err
+}
+
+// queryMQTTSpool reads the spool newest day first, returning up to limit
+// matching entries older than olderThan.
+func (app *App) queryMQTTSpool(q mqttLogQuery, olderThan time.Time, limit int, visible func(topic string) bool) ([]MQTTLogEntry, error) {
+	app.mqttSpool.sync()
+
+	var entries []MQTTLogEntry
+	dates := app.mqttSpool.segmentDates()
+	for i := len(dates) - 1; i >= 0 && len(entries) < limit; i-- {
+		date := dates[i]
+		if date > olderThan.UTC().Format(historyDateFormat) {
+			continue
+		}
+		if !q.from.IsZero() && date < q.from.UTC().Format(historyDateFormat) {
+			break
+		}
+
+		// Keep the newest matches of the day, which is stored oldest first
+		var day []MQTTLogEntry
+		err := app.mqttSpool.scanDay(date, func(line []byte) {
+			var entry MQTTLogEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				return
+			}
+			if !entry.Timestamp.Before(olderThan) || !q.matches(entry) || !visible(entry.Topic) {
+				return
+			}
+			day = append(day, entry)
+			if len(day) > limit-len(entries) {
+				day = append(day[:0], day[1:]...)
+			}
+		})
+		if err != nil {
+			return entries, err
+		}
+		for j := len(day) - 1; j >= 0; j-- {
+			entries = append(entries, day[j])
+		}
+	}
+	return entries, nil
+}
+
+// handleMQTTLog returns MQTT log entries, newest first. Query parameters:
+// topic (MQTT filter), search (payload regexp), direction, from, to, before
+// (RFC3339 or unix seconds) and limit.
+func (app *App) handleMQTTLog(w http.ResponseWriter, r *http.Request) {
+	q, err := parseMQTTLogQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config := app.getConfig()
+	userAccess := app.accessFor(r)
+	entries, err := app.queryMQTTLog(q, func(topic string) bool {
+		return userAccess.canSeeTopic(&config, topic)
+	})
+	if err != nil {
+		log.Printf("MQTT log query failed: %v", err)
+		http.Error(w, "MQTT log query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
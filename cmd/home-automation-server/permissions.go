@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// access describes what the current user may see and operate. A nil *access
+// (auth disabled) or one without a role is unrestricted.
+type access struct {
+	user string
+	role *Role
+	none bool // user no longer exists in config
+}
+
+func listContains(list, value string) bool {
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRoles(config *Config) error {
+	roles := make(map[string]bool)
+	for i, role := range config.Auth.Roles {
+		if role.ID == "" {
+			return fmt.Errorf("role %d: missing id", i)
+		}
+		if roles[role.ID] {
+			return fmt.Errorf("role '%s': duplicate id", role.ID)
+		}
+		roles[role.ID] = true
+	}
+
+	for _, user := range config.Auth.Users {
+		if user.Role != "" && !roles[user.Role] {
+			return fmt.Errorf("user '%s': unknown role '%s'", user.Name, user.Role)
+		}
+	}
+
+	return nil
+}
+
+func (config *Config) findRole(id string) *Role {
+	for i := range config.Auth.Roles {
+		if config.Auth.Roles[i].ID == id {
+			return &config.Auth.Roles[i]
+		}
+	}
+	return nil
+}
+
+// findDevice looks up a device, or the virtual device of a group.
+func (config *Config) findDevice(id string) (Device, bool) {
+	for _, device := range config.Devices {
+		if device.ID == id {
+			return device, true
+		}
+	}
+	if group, exists := config.findGroup(id); exists {
+		return groupDevice(config, group), true
+	}
+	return Device{}, false
+}
+
+// accessForUser resolves a user's role from the given config so that role
+// changes apply on the next request after a reload.
+func accessForUser(config *Config, name string) *access {
+	if !authEnabled(config) {
+		return nil
+	}
+
+	user, exists := config.findUser(name)
+	if !exists {
+		return &access{user: name, none: true}
+	}
+	return &access{user: user.Name, role: config.findRole(user.Role)}
+}
+
+func (app *App) accessFor(r *http.Request) *access {
+	config := app.getConfig()
+	s := sessionFromRequest(r)
+	if s == nil {
+		return accessForUser(&config, "")
+	}
+	return accessForUser(&config, s.user)
+}
+
+func (a *access) unrestricted() bool {
+	return a == nil || (!a.none && a.role == nil)
+}
+
+func (a *access) isAdmin() bool {
+	return a.unrestricted() || (!a.none && a.role.Admin)
+}
+
+func (a *access) canSeeDevice(device Device) bool {
+	if a.unrestricted() {
+		return true
+	}
+	if a.none {
+		return false
+	}
+
+	deny := a.role.Deny
+	if listContains(deny.Devices, device.ID) || listContains(deny.Categories, device.Category) {
+		return false
+	}
+
+	allow := a.role.Allow
+	if allow.Devices == "" && allow.Categories == "" {
+		return true
+	}
+	return listContains(allow.Devices, device.ID) || listContains(allow.Categories, device.Category)
+}
+
+func (a *access) canUseControl(device Device, control Control) bool {
+	if !a.canSeeDevice(device) {
+		return false
+	}
+	if a.unrestricted() {
+		return true
+	}
+
+	if listContains(a.role.Deny.ControlTypes, control.Type) {
+		return false
+	}
+	return a.role.Allow.ControlTypes == "" || listContains(a.role.Allow.ControlTypes, control.Type)
+}
+
+// canOperate reports whether a control may be used, including on every
+// member that has it when device is a group.
+func (a *access) canOperate(config *Config, device Device, control Control) bool {
+	if !a.canUseControl(device, control) {
+		return false
+	}
+	for _, memberID := range device.Members {
+		member, _ := config.findDevice(memberID)
+		c, exists := deviceControl(member, control.Label)
+		if !exists {
+			continue // runControl skips members without the control too
+		}
+		if !a.canUseControl(member, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// canUseScene reports whether a scene may be activated. Restricted users need
+// access to every control it triggers; publishes and local commands are not
+// tied to a device, so scenes with those are limited to admins.
+func (a *access) canUseScene(config *Config, scene Scene) bool {
+	if a.isAdmin() {
+		return true
+	}
+	for _, action := range scene.Actions {
+		if action.Topic != "" || action.LocalCommand != "" {
+			return false
+		}
+		if action.Device == "" {
+			continue
+		}
+		device, _ := config.findDevice(action.Device)
+		control, _ := config.findControl(action.Device, action.Control)
+		if !a.canOperate(config, device, control) {
+			return false
+		}
+	}
+	return true
+}
+
+// canSeeTopic reports whether an MQTT log entry for topic may be shown. Only
+// topics belonging to visible devices are shown to restricted users.
+func (a *access) canSeeTopic(config *Config, topic string) bool {
+	if a.unrestricted() {
+		return true
+	}
+
+	for _, device := range config.Devices {
+		if !a.canSeeDevice(device) {
+			continue
+		}
+		if device.hasStatusTopic(topic) || device.Availability.Topic == topic {
+			return true
+		}
+		for _, control := range device.Controls {
+			if control.Topic == topic {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *access) filterDevices(devices []Device) []Device {
+	if a.unrestricted() {
+		return devices
+	}
+
+	visible := make([]Device, 0, len(devices))
+	for _, device := range devices {
+		if !a.canSeeDevice(device) {
+			continue
+		}
+
+		// Only render the controls this user may operate
+		controls := make([]Control, 0, len(device.Controls))
+		for _, control := range device.Controls {
+			if a.canUseControl(device, control) {
+				controls = append(controls, control)
+			}
+		}
+		device.Controls = controls
+		visible = append(visible, device)
+	}
+	return visible
+}
+
+// filterCategories keeps the category tabs that contain at least one of the
+// given visible devices.
+func (a *access) filterCategories(categories []Category, visibleDevices []Device) []Category {
+	if a.unrestricted() {
+		return categories
+	}
+
+	used := make(map[string]bool)
+	for _, device := range visibleDevices {
+		used[device.Category] = true
+	}
+
+	visible := make([]Category, 0, len(categories))
+	for _, category := range categories {
+		if used[category.ID] {
+			visible = append(visible, category)
+		}
+	}
+	return visible
+}
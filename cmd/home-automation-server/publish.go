@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// PublishMessage is a message sent from the publish console.
+type PublishMessage struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+// PublishRecord is one entry in the publish console's history.
+type PublishRecord struct {
+	PublishMessage
+	User string    `json:"user,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// PublishSnippet is a named message saved for reuse.
+type PublishSnippet struct {
+	Name string `json:"name"`
+	PublishMessage
+}
+
+// publishConsole is the console state kept in the publish file.
+type publishConsole struct {
+	History  []PublishRecord  `json:"history"`  // newest first
+	Snippets []PublishSnippet `json:"snippets"` // sorted by name
+}
+
+func (m PublishMessage) validate() error {
+	if m.Topic == "" || strings.ContainsAny(m.Topic, "+#") {
+		return fmt.Errorf("A topic without wildcards is required")
+	}
+	if m.QoS > 2 {
+		return fmt.Errorf("QoS must be 0, 1 or 2")
+	}
+	return nil
+}
+
+// loadPublishConsole reads saved snippets and history from the publish file.
+func (app *App) loadPublishConsole() {
+	file := app.config.Publish.File
+	if file == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to read publish console file: %v", err)
+		return
+	}
+
+	if err := json.Unmarshal(data, &app.console); err != nil {
+		log.Printf("Failed to parse publish console file: %v", err)
+		return
+	}
+	log.Printf("Loaded %d publish snippets from %s", len(app.console.Snippets), file)
+}
+
+// savePublishConsole writes the console state; the caller holds consoleMutex.
+func (app *App) savePublishConsole() error {
+	file := app.getConfig().Publish.File
+	if file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(app.console, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(file, data, 0644)
+}
+
+// recordPublish adds a message to the history, moving a repeated message to
+// the top instead of listing it twice.
+func (app *App) recordPublish(record PublishRecord) {
+	app.consoleMutex.Lock()
+	defer app.consoleMutex.Unlock()
+
+	history := []PublishRecord{record}
+	for _, previous := range app.console.History {
+		if previous.PublishMessage != record.PublishMessage {
+			history = append(history, previous)
+		}
+	}
+	if size := app.getConfig().Publish.HistorySize; len(history) > size {
+		history = history[:size]
+	}
+	app.console.History = history
+
+	if err := app.savePublishConsole(); err != nil {
+		log.Printf("Failed to save publish console file: %v", err)
+	}
+}
+
+func (app *App) getPublishConsole() publishConsole {
+	app.consoleMutex.Lock()
+	defer app.consoleMutex.Unlock()
+
+	return publishConsole{
+		History:  append([]PublishRecord{}, app.console.History...),
+		Snippets: append([]PublishSnippet{}, app.console.Snippets...),
+	}
+}
+
+// allowPublish rejects the request unless publishing is enabled and the user
+// is an admin. Config validation ensures publishing is only enabled with
+// auth users configured.
+func (app *App) allowPublish(w http.ResponseWriter, r *http.Request) bool {
+	if !app.getConfig().AllowPublish {
+		http.Error(w, "Publishing is disabled", http.StatusNotFound)
+		return false
+	}
+	if !app.accessFor(r).isAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handlePublish publishes an arbitrary message (POST) or returns the publish
+// history and saved snippets (GET). It is disabled unless the config sets
+// allowPublish="true" and is limited to admin users.
+func (app *App) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !app.allowPublish(w, r) {
+		return
+	}
+
+	if r.Method == "GET" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.getPublishConsole())
+		return
+	}
+
+	var req PublishMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.publishMQTTQoS(req.Topic, req.Payload, req.QoS, req.Retain); err != nil {
+		log.Printf("Failed to publish MQTT message: %v", err)
+		http.Error(w, "Failed to publish", http.StatusInternalServerError)
+		return
+	}
+	user := app.accessFor(r).user
+	log.Printf("Published MQTT message for %s - Topic: %s, QoS: %d, Retain: %v, Payload: %s",
+		user, req.Topic, req.QoS, req.Retain, req.Payload)
+
+	record := PublishRecord{
+		PublishMessage: req,
+		User:           user,
+		Time:           time.Now(),
+	}
+	app.recordPublish(record)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+// handlePublishSnippets saves a snippet (POST, replacing one of the same
+// name) or deletes one (DELETE ?name=), returning the saved snippets.
+func (app *App) handlePublishSnippets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !app.allowPublish(w, r) {
+		return
+	}
+
+	var snippet PublishSnippet
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&snippet); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		snippet.Name = strings.TrimSpace(snippet.Name)
+		if snippet.Name == "" {
+			http.Error(w, "A snippet name is required", http.StatusBadRequest)
+			return
+		}
+		if err := snippet.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		snippet.Name = r.URL.Query().Get("name")
+	}
+
+	app.consoleMutex.Lock()
+	snippets := make([]PublishSnippet, 0, len(app.console.Snippets)+1)
+	found := false
+	for _, existing := range app.console.Snippets {
+		if existing.Name == snippet.Name {
+			found = true
+			continue
+		}
+		snippets = append(snippets, existing)
+	}
+	if r.Method == "POST" {
+		// Keep snippets sorted by name
+		i := 0
+		for i < len(snippets) && snippets[i].Name < snippet.Name {
+			i++
+		}
+		snippets = append(snippets[:i], append([]PublishSnippet{snippet}, snippets[i:]...)...)
+	}
+	app.console.Snippets = snippets
+	err := app.savePublishConsole()
+	app.consoleMutex.Unlock()
+
+	if r.Method == "DELETE" && !found {
+		http.Error(w, "Snippet not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save publish console file: %v", err)
+		http.Error(w, "Failed to save snippets", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.getPublishConsole().Snippets)
+}
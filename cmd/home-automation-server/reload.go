@@ -0,0 +1,217 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// File monitoring functions, mirroring command_runner_server's watcher
+func getFileModTime(filename string) (time.Time, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (app *App) getWatchedFiles() []string {
+	app.configMutex.RLock()
+	files := []string{app.configFile}
+	app.configMutex.RUnlock()
+
+	// Add HTML template files
+	templatePattern := filepath.Join(app.webDir, "templates", "*.html")
+	if matches, err := filepath.Glob(templatePattern); err == nil {
+		files = append(files, matches...)
+	}
+
+	return files
+}
+
+func (app *App) initFileWatcher() {
+	app.watchedFiles = make(map[string]time.Time)
+	for _, file := range app.getWatchedFiles() {
+		if modTime, err := getFileModTime(file); err == nil {
+			app.watchedFiles[file] = modTime
+		}
+	}
+}
+
+func (app *App) checkForChanges() bool {
+	changed := false
+
+	for _, file := range app.getWatchedFiles() {
+		currentModTime, err := getFileModTime(file)
+		if err != nil {
+			continue
+		}
+
+		if lastModTime, exists := app.watchedFiles[file]; !exists || currentModTime.After(lastModTime) {
+			log.Printf("File changed: %s", file)
+			app.watchedFiles[file] = currentModTime
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func (app *App) startFileWatcher() {
+	app.initFileWatcher()
+
+	ticker := time.NewTicker(1 * time.Second)
+	go func() {
+		for range ticker.C {
+			if app.checkForChanges() {
+				log.Println("Changes detected, reloading configuration...")
+				app.reloadConfig()
+			}
+		}
+	}()
+}
+
+// reloadConfig applies an edited config file to the running server. The new
+// config is validated first; on error the current config is kept.
+func (app *App) reloadConfig() error {
+	app.configMutex.RLock()
+	configFile := app.configFile
+	app.configMutex.RUnlock()
+
+	newConfig, err := parseConfig(configFile)
+	if err != nil {
+		log.Printf("Error reloading config, keeping current configuration: %v", err)
+		return err
+	}
+
+	if err := app.loadTemplates(); err != nil {
+		log.Printf("Error reloading templates, keeping current configuration: %v", err)
+		return err
+	}
+
+	app.devicesMutex.Lock()
+	defer app.devicesMutex.Unlock()
+
+	app.configMutex.Lock()
+	oldConfig := app.config
+
+	// Connection and storage settings are only applied at startup
+	if newConfig.MQTT != oldConfig.MQTT {
+		log.Println("MQTT settings changed; restart the server to apply them")
+	}
+	newConfig.MQTT = oldConfig.MQTT
+	newConfig.History = oldConfig.History
+	newConfig.MQTTLogSpool = oldConfig.MQTTLogSpool
+	newConfig.Publish.File = oldConfig.Publish.File
+	newConfig.TopicTree = oldConfig.TopicTree
+	newConfig.SuppressTimestamp = oldConfig.SuppressTimestamp
+	newConfig.Discovery = oldConfig.Discovery
+	newConfig.Devices = app.withDiscoveredDevices(&newConfig)
+
+	app.config = newConfig
+	app.configMutex.Unlock()
+
+	app.applyDeviceChanges(oldConfig.Devices, newConfig.Devices)
+	app.refreshGroups()
+	app.resetRules()
+	app.loadSchedules()
+	go app.publishDiscovery()
+
+	logConfig(configFile, newConfig)
+	app.broadcastMessage(WebSocketMessage{
+		Type: "config_reloaded",
+	})
+	app.broadcastSchedules()
+	return nil
+}
+
+// applyDeviceChanges updates the runtime device status map and MQTT status
+// subscriptions to match a reloaded device list.
+func (app *App) applyDeviceChanges(oldDevices, newDevices []Device) {
+	oldTopics := statusTopicOwners(oldDevices)
+	newTopics := statusTopicOwners(newDevices)
+	oldAvailability := availabilityTopics(oldDevices)
+	newAvailability := availabilityTopics(newDevices)
+	oldByID := make(map[string]Device, len(oldDevices))
+	for _, device := range oldDevices {
+		oldByID[device.ID] = device
+	}
+
+	now := time.Now()
+	app.statusMutex.Lock()
+	current := make(map[string]bool)
+	for _, device := range newDevices {
+		current[device.ID] = true
+		if deviceStatus, exists := app.deviceStatus[device.ID]; exists {
+			deviceStatus.Name = device.Name
+			deviceStatus.Category = device.Category
+			deviceStatus.Units = fieldUnits(device)
+			deviceStatus.Controls = device.Controls
+			if old := oldByID[device.ID]; !reflect.DeepEqual(old.StatusTopics, device.StatusTopics) || !reflect.DeepEqual(old.Fields, device.Fields) {
+				// Let replayed retained messages through the new mapping
+				deviceStatus.lastPayloads = nil
+			}
+			if oldByID[device.ID].Availability.Topic != device.Availability.Topic {
+				// The new topic reports its state once subscribed
+				deviceStatus.offline = false
+			}
+			app.updateAvailability(device, deviceStatus, now)
+			continue
+		}
+		app.deviceStatus[device.ID] = newDeviceStatus(device)
+		log.Printf("Added device: %s", device.ID)
+	}
+	for _, group := range app.getConfig().Groups {
+		current[group.ID] = true
+	}
+	for deviceID := range app.deviceStatus {
+		if !current[deviceID] {
+			delete(app.deviceStatus, deviceID)
+			log.Printf("Removed device: %s", deviceID)
+		}
+	}
+	app.statusMutex.Unlock()
+
+	if app.mqttClient == nil {
+		return
+	}
+
+	for topic := range oldTopics {
+		if _, exists := newTopics[topic]; exists {
+			continue
+		}
+		token := app.mqttClient.Unsubscribe(topic)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Failed to unsubscribe from %s: %v", topic, token.Error())
+		} else {
+			log.Printf("Unsubscribed from status topic: %s", topic)
+		}
+	}
+	// A filter whose owning devices changed is resubscribed so the broker
+	// replays retained status to the new owner
+	for topic, owners := range newTopics {
+		if oldTopics[topic] == owners {
+			continue
+		}
+		app.subscribeToStatusTopic(topic)
+	}
+
+	for topic := range oldAvailability {
+		if newAvailability[topic] {
+			continue
+		}
+		token := app.mqttClient.Unsubscribe(topic)
+		if token.Wait() && token.Error() != nil {
+			log.Printf("Failed to unsubscribe from %s: %v", topic, token.Error())
+		} else {
+			log.Printf("Unsubscribed from availability topic: %s", topic)
+		}
+	}
+	for topic := range newAvailability {
+		if !oldAvailability[topic] {
+			app.subscribeToAvailabilityTopic(topic)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ruleState tracks whether a rule's conditions currently hold so that
+// actions fire once per transition rather than on every status update.
+type ruleState struct {
+	active     bool
+	timer      *time.Timer
+	generation int // bumped when the timer is cancelled, as it may already be running
+}
+
+func validateRules(config *Config) error {
+	devices := make(map[string]bool)
+	for _, device := range config.Devices {
+		devices[device.ID] = true
+	}
+
+	seen := make(map[string]bool)
+	for i, rule := range config.Rules {
+		if rule.ID == "" {
+			return fmt.Errorf("rule %d: missing id", i)
+		}
+		if seen[rule.ID] {
+			return fmt.Errorf("rule '%s': duplicate id", rule.ID)
+		}
+		seen[rule.ID] = true
+
+		if !devices[rule.Trigger.Device] {
+			return fmt.Errorf("rule '%s': unknown trigger device '%s'", rule.ID, rule.Trigger.Device)
+		}
+		for _, cond := range rule.Conditions {
+			if cond.Device != "" && !devices[cond.Device] {
+				return fmt.Errorf("rule '%s': unknown condition device '%s'", rule.ID, cond.Device)
+			}
+			switch cond.Operator {
+			case "", "eq", "ne", "gt", "gte", "lt", "lte", "contains":
+			default:
+				return fmt.Errorf("rule '%s': unknown operator '%s'", rule.ID, cond.Operator)
+			}
+		}
+		for _, action := range rule.Actions {
+			switch action.Type {
+			case "mqtt":
+				if action.Topic == "" {
+					return fmt.Errorf("rule '%s': mqtt action requires a topic", rule.ID)
+				}
+			case "localCommand":
+				if action.LocalCommand == "" {
+					return fmt.Errorf("rule '%s': localCommand action requires a command", rule.ID)
+				}
+			default:
+				return fmt.Errorf("rule '%s': unknown action type '%s'", rule.ID, action.Type)
+			}
+		}
+	}
+
+	return nil
+}
+
+// evaluateRules checks every rule triggered by deviceID. It must be called
+// without statusMutex held.
+func (app *App) evaluateRules(deviceID string) {
+	for _, rule := range app.getConfig().Rules {
+		if rule.Disabled || rule.Trigger.Device != deviceID {
+			continue
+		}
+		app.evaluateRule(rule)
+	}
+}
+
+func (app *App) evaluateRule(rule Rule) {
+	matched := app.ruleConditionsMet(rule)
+
+	app.rulesMutex.Lock()
+	defer app.rulesMutex.Unlock()
+
+	state, exists := app.ruleStates[rule.ID]
+	if !exists {
+		state = &ruleState{}
+		app.ruleStates[rule.ID] = state
+	}
+
+	if !matched {
+		if state.timer != nil {
+			state.timer.Stop()
+			state.timer = nil
+			state.generation++
+			log.Printf("Rule '%s': conditions no longer met, cancelled pending actions", rule.ID)
+		}
+		state.active = false
+		return
+	}
+
+	// Already fired or waiting for the hold period to elapse
+	if state.active || state.timer != nil {
+		return
+	}
+
+	if rule.Trigger.For <= 0 {
+		state.active = true
+		go app.runRuleActions(rule)
+		return
+	}
+
+	log.Printf("Rule '%s': conditions met, waiting %d seconds", rule.ID, rule.Trigger.For)
+	generation := state.generation
+	state.timer = time.AfterFunc(time.Duration(rule.Trigger.For)*time.Second, func() {
+		// Re-check in case the status changed without a new update reaching us
+		stillMatched := app.ruleConditionsMet(rule)
+
+		app.rulesMutex.Lock()
+		if state.generation != generation {
+			// Cancelled after the timer fired but before we got the lock
+			app.rulesMutex.Unlock()
+			return
+		}
+		state.timer = nil
+		if stillMatched {
+			state.active = true
+		}
+		app.rulesMutex.Unlock()
+
+		if stillMatched {
+			app.runRuleActions(rule)
+		}
+	})
+}
+
+// resetRules cancels pending rule timers so a reloaded rule set starts fresh.
+func (app *App) resetRules() {
+	app.rulesMutex.Lock()
+	defer app.rulesMutex.Unlock()
+
+	for _, state := range app.ruleStates {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+		state.generation++
+	}
+	app.ruleStates = make(map[string]*ruleState)
+}
+
+func (app *App) ruleConditionsMet(rule Rule) bool {
+	app.statusMutex.RLock()
+	defer app.statusMutex.RUnlock()
+
+	for _, cond := range rule.Conditions {
+		deviceID := cond.Device
+		if deviceID == "" {
+			deviceID = rule.Trigger.Device
+		}
+
+		deviceStatus, exists := app.deviceStatus[deviceID]
+		if !exists {
+			return false
+		}
+		value, exists := deviceStatus.Status[cond.Field]
+		if !exists {
+			return false
+		}
+		if !compareRuleValue(fmt.Sprint(value), cond.Operator, cond.Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareRuleValue compares numerically when both sides parse as numbers and
+// falls back to string comparison otherwise.
+func compareRuleValue(actual, operator, expected string) bool {
+	if operator == "contains" {
+		return strings.Contains(actual, expected)
+	}
+
+	a, errA := strconv.ParseFloat(actual, 64)
+	b, errB := strconv.ParseFloat(expected, 64)
+	numeric := errA == nil && errB == nil
+
+	var cmp int
+	if numeric {
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(actual, expected)
+	}
+
+	switch operator {
+	case "", "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+func (app *App) runRuleActions(rule Rule) {
+	log.Printf("Rule '%s' fired, running %d actions", rule.ID, len(rule.Actions))
+
+	for _, action := range rule.Actions {
+		switch action.Type {
+		case "mqtt":
+			if err := app.publishMQTT(action.Topic, action.Payload, action.Retain); err != nil {
+				log.Printf("Rule '%s': failed to publish to %s: %v", rule.ID, action.Topic, err)
+			}
+		case "localCommand":
+			app.startLocalCommand("", action.LocalCommand, "rule "+rule.ID)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func validateScenes(config *Config) error {
+	seen := make(map[string]bool)
+	for i, scene := range config.Scenes {
+		if scene.ID == "" {
+			return fmt.Errorf("scene %d: missing id", i)
+		}
+		if seen[scene.ID] {
+			return fmt.Errorf("scene '%s': duplicate id", scene.ID)
+		}
+		seen[scene.ID] = true
+
+		for j, action := range scene.Actions {
+			kinds := 0
+			for _, set := range []bool{action.Device != "", action.Topic != "", action.LocalCommand != "", action.Delay != 0} {
+				if set {
+					kinds++
+				}
+			}
+			if kinds != 1 {
+				return fmt.Errorf("scene '%s' action %d: requires exactly one of a device control, topic, localCommand or delay", scene.ID, j)
+			}
+
+			switch {
+			case action.Device != "":
+				control, exists := config.findControl(action.Device, action.Control)
+				if !exists {
+					return fmt.Errorf("scene '%s': unknown control '%s' on device '%s'", scene.ID, action.Control, action.Device)
+				}
+				if _, err := controlValue(control, actionValue(action.Value)); err != nil {
+					return fmt.Errorf("scene '%s': control '%s' on device '%s': %v", scene.ID, action.Control, action.Device, err)
+				}
+			case action.Topic != "":
+				if strings.ContainsAny(action.Topic, "+#") {
+					return fmt.Errorf("scene '%s': topic '%s' cannot contain wildcards", scene.ID, action.Topic)
+				}
+			case action.Delay < 0:
+				return fmt.Errorf("scene '%s': delay must not be negative", scene.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// actionValue converts the value attribute of a scene or schedule action
+// for controlValue; an empty attribute means no value.
+func actionValue(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func (config *Config) findScene(id string) (Scene, bool) {
+	for _, scene := range config.Scenes {
+		if scene.ID == id {
+			return scene, true
+		}
+	}
+	return Scene{}, false
+}
+
+// activateScene runs a scene's actions in order in the background.
+func (app *App) activateScene(scene Scene, user string) {
+	source := "scene " + scene.ID
+	log.Printf("Scene '%s' activated by %s, running %d actions", scene.ID, user, len(scene.Actions))
+
+	app.broadcastTo(WebSocketMessage{
+		Type: "scene_activated",
+		Data: SceneInfo{ID: scene.ID, Name: scene.Name, Icon: scene.Icon, Actions: len(scene.Actions)},
+	}, func(a *access) bool {
+		config := app.getConfig()
+		return a.canUseScene(&config, scene)
+	})
+
+	go func() {
+		for _, action := range scene.Actions {
+			switch {
+			case action.Delay > 0:
+				time.Sleep(time.Duration(action.Delay) * time.Millisecond)
+			case action.Device != "":
+				if err := app.runSceneControl(action, user, source); err != nil {
+					log.Printf("Scene '%s': failed to set '%s' on %s: %v", scene.ID, action.Control, action.Device, err)
+				}
+			case action.Topic != "":
+				if err := app.publishMQTT(action.Topic, action.Payload, action.Retain); err != nil {
+					log.Printf("Scene '%s': failed to publish to %s: %v", scene.ID, action.Topic, err)
+				}
+			case action.LocalCommand != "":
+				app.startLocalCommand("", action.LocalCommand, source)
+			}
+		}
+	}()
+}
+
+func (app *App) runSceneControl(action SceneAction, user, source string) error {
+	config := app.getConfig()
+	device, _ := config.findDevice(action.Device)
+	control, exists := config.findControl(action.Device, action.Control)
+	if !exists {
+		return fmt.Errorf("control no longer exists")
+	}
+	_, err := app.setControl(device, control, actionValue(action.Value), user, source)
+	return err
+}
+
+// captureScene builds a scene that restores the current state of every
+// control bound to a status field, optionally only on the given devices.
+func (app *App) captureScene(id, name string, deviceIDs []string) Scene {
+	config := app.getConfig()
+	scene := Scene{ID: id, Name: name}
+
+	selected := make(map[string]bool, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		selected[deviceID] = true
+	}
+
+	app.statusMutex.RLock()
+	defer app.statusMutex.RUnlock()
+
+	for _, device := range config.Devices {
+		// Discovered devices are not in the config file
+		if device.Source != "" {
+			continue
+		}
+		if len(selected) > 0 && !selected[device.ID] {
+			continue
+		}
+		deviceStatus, exists := app.deviceStatus[device.ID]
+		if !exists {
+			continue
+		}
+		for _, control := range device.Controls {
+			state, ok := controlState(control, deviceStatus.Status)
+			if !ok {
+				continue
+			}
+			scene.Actions = append(scene.Actions, SceneAction{
+				Device:  device.ID,
+				Control: control.Label,
+				Value:   sceneValueString(state),
+			})
+		}
+	}
+	return scene
+}
+
+func sceneValueString(state interface{}) string {
+	switch value := state.(type) {
+	case bool:
+		return strconv.FormatBool(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return fmt.Sprint(state)
+}
+
+func (app *App) getSceneInfo(userAccess *access) []SceneInfo {
+	config := app.getConfig()
+	infos := make([]SceneInfo, 0, len(config.Scenes))
+	for _, scene := range config.Scenes {
+		if !userAccess.canUseScene(&config, scene) {
+			continue
+		}
+		infos = append(infos, SceneInfo{
+			ID:      scene.ID,
+			Name:    scene.Name,
+			Icon:    scene.Icon,
+			Actions: len(scene.Actions),
+		})
+	}
+	return infos
+}
+
+// handleScenes lists the scenes the user may activate (GET) or activates
+// one by ID (POST).
+func (app *App) handleScenes(w http.ResponseWriter, r *http.Request) {
+	userAccess := app.accessFor(r)
+
+	if r.Method == "POST" {
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		config := app.getConfig()
+		scene, exists := config.findScene(req.ID)
+		if !exists {
+			http.Error(w, "Scene not found", http.StatusNotFound)
+			return
+		}
+		if !userAccess.canUseScene(&config, scene) {
+			log.Printf("Denied scene request from %s for %s", userAccess.user, scene.ID)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		app.activateScene(scene, "user "+userAccess.user)
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.getSceneInfo(userAccess))
+}
+
+// handleSceneCapture saves the current device state as a new scene in the
+// config file.
+func (app *App) handleSceneCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !app.accessFor(r).isAdmin() {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		ID      string   `json:"id"`
+		Name    string   `json:"name"`
+		Devices []string `json:"devices"` // empty captures every device
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" {
+		req.ID = haSlug(req.Name)
+	}
+	if req.ID == "" {
+		http.Error(w, "A scene name is required", http.StatusBadRequest)
+		return
+	}
+
+	scene := app.captureScene(req.ID, req.Name, req.Devices)
+	if len(scene.Actions) == 0 {
+		http.Error(w, "No controls report a state to capture", http.StatusBadRequest)
+		return
+	}
+
+	config := app.getConfig()
+	config.Scenes = append(append([]Scene(nil), config.Scenes...), scene)
+	if err := validateScenes(&config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.appendConfigElement("scenes", "scene", scene); err != nil {
+		log.Printf("Failed to save scene %s: %v", scene.ID, err)
+		status := http.StatusInternalServerError
+		if _, invalid := err.(invalidConfigError); invalid {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	log.Printf("Captured scene %s with %d actions", scene.ID, len(scene.Actions))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scene)
+}
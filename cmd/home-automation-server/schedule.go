@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type scheduleState struct {
+	schedule Schedule
+	cron     *cronSpec
+	location Location
+	paused   bool
+	next     time.Time
+	last     time.Time
+}
+
+func validateSchedules(config *Config) error {
+	seen := make(map[string]bool)
+	for i, schedule := range config.Schedules {
+		if schedule.ID == "" {
+			return fmt.Errorf("schedule %d: missing id", i)
+		}
+		if seen[schedule.ID] {
+			return fmt.Errorf("schedule '%s': duplicate id", schedule.ID)
+		}
+		seen[schedule.ID] = true
+
+		switch {
+		case schedule.Cron != "" && schedule.Sun != "":
+			return fmt.Errorf("schedule '%s': cron and sun are mutually exclusive", schedule.ID)
+		case schedule.Cron != "":
+			if _, err := parseCron(schedule.Cron); err != nil {
+				return fmt.Errorf("schedule '%s': %v", schedule.ID, err)
+			}
+		case schedule.Sun == "sunrise" || schedule.Sun == "sunset":
+			if config.Location.Latitude == 0 && config.Location.Longitude == 0 {
+				return fmt.Errorf("schedule '%s': sun schedules require a <location>", schedule.ID)
+			}
+		case schedule.Sun != "":
+			return fmt.Errorf("schedule '%s': sun must be 'sunrise' or 'sunset'", schedule.ID)
+		default:
+			return fmt.Errorf("schedule '%s': requires a cron or sun attribute", schedule.ID)
+		}
+
+		for _, action := range schedule.Actions {
+			if action.Device != "" {
+				control, exists := config.findControl(action.Device, action.Control)
+				if !exists {
+					return fmt.Errorf("schedule '%s': unknown control '%s' on device '%s'",
+						schedule.ID, action.Control, action.Device)
+				}
+				if _, err := controlValue(control, actionValue(action.Value)); err != nil {
+					return fmt.Errorf("schedule '%s': control '%s' on device '%s': %v",
+						schedule.ID, action.Control, action.Device, err)
+				}
+			} else if action.Topic == "" {
+				return fmt.Errorf("schedule '%s': action requires a device control or a topic", schedule.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (app *App) startScheduler() {
+	app.loadSchedules()
+
+	ticker := time.NewTicker(1 * time.Second)
+	go func() {
+		for now := range ticker.C {
+			app.runDueSchedules(now)
+		}
+	}()
+}
+
+// loadSchedules (re)builds the runtime schedule state from the current config.
+// Schedules paused at runtime stay paused across a reload.
+func (app *App) loadSchedules() {
+	config := app.getConfig()
+
+	app.scheduleMutex.Lock()
+	defer app.scheduleMutex.Unlock()
+
+	now := time.Now()
+	schedules := make(map[string]*scheduleState)
+	for _, schedule := range config.Schedules {
+		state := &scheduleState{
+			schedule: schedule,
+			paused:   schedule.Paused,
+			location: config.Location,
+		}
+		if previous, exists := app.schedules[schedule.ID]; exists {
+			state.paused = previous.paused
+			state.last = previous.last
+		}
+		if schedule.Cron != "" {
+			// Already validated in parseConfig
+			state.cron, _ = parseCron(schedule.Cron)
+		}
+		state.next = state.nextFire(now)
+		schedules[schedule.ID] = state
+		log.Printf("Schedule '%s' next fires at %s", schedule.ID, state.next.Format(time.RFC3339))
+	}
+	app.schedules = schedules
+}
+
+func (state *scheduleState) nextFire(after time.Time) time.Time {
+	if state.cron != nil {
+		return state.cron.next(after)
+	}
+	offset := time.Duration(state.schedule.Offset) * time.Minute
+	return nextSunEvent(after, state.schedule.Sun, offset, state.location.Latitude, state.location.Longitude)
+}
+
+func (app *App) runDueSchedules(now time.Time) {
+	var due []Schedule
+
+	app.scheduleMutex.Lock()
+	for _, state := range app.schedules {
+		if state.next.IsZero() || now.Before(state.next) {
+			continue
+		}
+		if !state.paused {
+			due = append(due, state.schedule)
+			state.last = now
+		}
+		state.next = state.nextFire(now)
+	}
+	app.scheduleMutex.Unlock()
+
+	for _, schedule := range due {
+		app.fireSchedule(schedule)
+	}
+	if len(due) > 0 {
+		app.broadcastSchedules()
+	}
+}
+
+func (app *App) fireSchedule(schedule Schedule) {
+	log.Printf("Schedule '%s' fired, running %d actions", schedule.ID, len(schedule.Actions))
+
+	for _, action := range schedule.Actions {
+		if action.Device != "" {
+			config := app.getConfig()
+			control, exists := config.findControl(action.Device, action.Control)
+			if !exists {
+				log.Printf("Schedule '%s': control '%s' on device '%s' no longer exists",
+					schedule.ID, action.Control, action.Device)
+				continue
+			}
+			device, _ := config.findDevice(action.Device)
+			if _, err := app.runControl(device, control, actionValue(action.Value), "schedule "+schedule.ID, "schedule "+schedule.ID); err != nil {
+				log.Printf("Schedule '%s': failed to trigger '%s' on %s: %v",
+					schedule.ID, action.Control, action.Device, err)
+			}
+			continue
+		}
+
+		if err := app.publishMQTT(action.Topic, action.Payload, action.Retain); err != nil {
+			log.Printf("Schedule '%s': failed to publish to %s: %v", schedule.ID, action.Topic, err)
+		}
+	}
+}
+
+func (app *App) getScheduleInfo() []ScheduleInfo {
+	config := app.getConfig()
+
+	app.scheduleMutex.Lock()
+	defer app.scheduleMutex.Unlock()
+
+	infos := make([]ScheduleInfo, 0, len(config.Schedules))
+	for _, schedule := range config.Schedules {
+		state, exists := app.schedules[schedule.ID]
+		if !exists {
+			continue
+		}
+
+		info := ScheduleInfo{
+			ID:      schedule.ID,
+			Name:    schedule.Name,
+			Trigger: schedule.Cron,
+			Paused:  state.paused,
+		}
+		if schedule.Sun != "" {
+			info.Trigger = fmt.Sprintf("%s%+dm", schedule.Sun, schedule.Offset)
+		}
+		if !state.next.IsZero() {
+			info.NextFire = state.next.Format(time.RFC3339)
+		}
+		if !state.last.IsZero() {
+			info.LastFire = state.last.Format(time.RFC3339)
+		}
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+func (app *App) broadcastSchedules() {
+	app.broadcastMessage(WebSocketMessage{
+		Type: "schedules",
+		Data: app.getScheduleInfo(),
+	})
+}
+
+func (app *App) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		if !app.accessFor(r).isAdmin() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			ID     string `json:"id"`
+			Paused bool   `json:"paused"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		app.scheduleMutex.Lock()
+		state, exists := app.schedules[req.ID]
+		if exists {
+			state.paused = req.Paused
+		}
+		app.scheduleMutex.Unlock()
+
+		if !exists {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+
+		log.Printf("Schedule '%s' paused=%v", req.ID, req.Paused)
+		app.broadcastSchedules()
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app.getScheduleInfo())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// scheduleStateSave writes the device status map to the state file after the
+// configured delay, coalescing bursts of updates into a single write.
+func (app *App) scheduleStateSave() {
+	config := app.getConfig()
+	if config.State.File == "" {
+		return
+	}
+
+	app.stateMutex.Lock()
+	defer app.stateMutex.Unlock()
+
+	if app.stateSaveTimer != nil {
+		return
+	}
+
+	delay := time.Duration(config.State.SaveDelay) * time.Second
+	app.stateSaveTimer = time.AfterFunc(delay, func() {
+		app.stateMutex.Lock()
+		app.stateSaveTimer = nil
+		app.stateMutex.Unlock()
+
+		if err := app.saveState(); err != nil {
+			log.Printf("Failed to save device state: %v", err)
+		}
+	})
+}
+
+func (app *App) saveState() error {
+	stateFile := app.getConfig().State.File
+
+	app.statusMutex.RLock()
+	state := make(map[string]map[string]interface{}, len(app.deviceStatus))
+	for deviceID, deviceStatus := range app.deviceStatus {
+		if len(deviceStatus.Status) > 0 {
+			state[deviceID] = deviceStatus.Status
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	app.statusMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(stateFile, data, 0644)
+}
+
+// writeFileAtomic replaces file with data. It writes to a temporary file
+// first so a crash never leaves a truncated file.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmpFile := file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, file); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
+
+// restoreState loads the last saved status of each configured device. Restored
+// values are marked stale until the device publishes again.
+func (app *App) restoreState() {
+	if app.config.State.File == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(app.config.State.File)
+	if os.IsNotExist(err) {
+		log.Printf("No saved device state at %s", app.config.State.File)
+		return
+	} else if err != nil {
+		log.Printf("Failed to read device state: %v", err)
+		return
+	}
+
+	var state map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Failed to parse device state: %v", err)
+		return
+	}
+
+	app.statusMutex.Lock()
+	defer app.statusMutex.Unlock()
+
+	restored := 0
+	for deviceID, status := range state {
+		deviceStatus, exists := app.deviceStatus[deviceID]
+		if !exists {
+			continue
+		}
+		status["stale"] = true
+		deviceStatus.Status = status
+		restored++
+	}
+
+	log.Printf("Restored last known state for %d devices from %s", restored, app.config.State.File)
+}
+
+// requestDeviceStatus publishes each device's configured refresh payload so
+// devices report their current state instead of waiting for the next change.
+func (app *App) requestDeviceStatus() {
+	for _, device := range app.getConfig().Devices {
+		if device.Refresh.Topic == "" {
+			continue
+		}
+
+		if err := app.publishMQTT(device.Refresh.Topic, device.Refresh.Payload, false); err != nil {
+			log.Printf("Failed to request status from %s: %v", device.ID, err)
+		} else {
+			log.Printf("Requested status from %s on %s", device.ID, device.Refresh.Topic)
+		}
+	}
+}
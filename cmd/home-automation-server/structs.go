@@ -4,6 +4,7 @@ import (
 	"encoding/xml"
 	"html/template"
 	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gorilla/websocket"
@@ -11,12 +12,28 @@ import (
 
 // Configuration structures
 type Config struct {
-	XMLName           xml.Name   `xml:"config"`
-	MQTT              MQTTConfig `xml:"mqtt"`
-	Devices           []Device   `xml:"devices>device"`
-	Categories        []Category `xml:"categories>category"`
-	SuppressTimestamp bool       `xml:"suppressTimestamp,attr"`
-	MQTTLogSize       int        `xml:"mqttLogSize,attr"`
+	XMLName           xml.Name      `xml:"config"`
+	MQTT              MQTTConfig    `xml:"mqtt"`
+	Devices           []Device      `xml:"devices>device"`
+	Groups            []Group       `xml:"groups>group"`
+	Categories        []Category    `xml:"categories>category"`
+	Rules             []Rule        `xml:"rules>rule"`
+	Location          Location      `xml:"location"`
+	Schedules         []Schedule    `xml:"schedules>schedule"`
+	Scenes            []Scene       `xml:"scenes>scene"`
+	History           History       `xml:"history"`
+	MQTTLogSpool      MQTTLogSpool  `xml:"mqttLogSpool"` // MQTT log on disk, beyond mqttLogSize
+	Publish           Publish       `xml:"publish"`
+	TopicTree         TopicTree     `xml:"topicTree"`
+	State             State         `xml:"state"`
+	Auth              Auth          `xml:"auth"`
+	HomeAssistant     HomeAssistant `xml:"homeAssistant"`
+	Discovery         Discovery     `xml:"discovery"`
+	SuppressTimestamp bool          `xml:"suppressTimestamp,attr"`
+	MQTTLogSize       int           `xml:"mqttLogSize,attr"`
+	AllowPublish      bool          `xml:"allowPublish,attr"`   // enables /api/publish for admins
+	CommandTimeout    int           `xml:"commandTimeout,attr"` // seconds
+	CommandLogSize    int           `xml:"commandLogSize,attr"`
 }
 
 type MQTTConfig struct {
@@ -27,24 +44,145 @@ type MQTTConfig struct {
 	ClientID      string `xml:"clientId,attr"`
 	RetryInterval int    `xml:"retryInterval,attr"` // seconds between connection attempts
 	MaxRetries    int    `xml:"maxRetries,attr"`    // 0 = infinite retries
+
+	// Transport: scheme is tcp (default), ssl, ws or wss. TLS settings apply
+	// to ssl and wss; path is the WebSocket endpoint (default /mqtt).
+	Scheme             string `xml:"scheme,attr"`
+	Path               string `xml:"path,attr"`
+	CAFile             string `xml:"caFile,attr"`
+	CertFile           string `xml:"certFile,attr"`
+	KeyFile            string `xml:"keyFile,attr"`
+	InsecureSkipVerify bool   `xml:"insecureSkipVerify,attr"`
+	ALPN               string `xml:"alpn,attr"` // comma-separated protocol names
+
+	// Retained online/offline state of this server, with the offline payload
+	// registered as the connection's last will
+	AvailabilityTopic string `xml:"availabilityTopic,attr"`
+	PayloadOnline     string `xml:"payloadOnline,attr"`  // default "online"
+	PayloadOffline    string `xml:"payloadOffline,attr"` // default "offline"
+}
+
+// HomeAssistant controls publishing of Home Assistant MQTT discovery configs
+type HomeAssistant struct {
+	Enabled         bool   `xml:"enabled,attr"`
+	DiscoveryPrefix string `xml:"discoveryPrefix,attr"` // default "homeassistant"
+	NodeID          string `xml:"nodeId,attr"`          // default: MQTT client ID
+}
+
+// Discovery creates devices at runtime from discovery messages published by
+// Home Assistant integrations, Tasmota and Zigbee2MQTT
+type Discovery struct {
+	Enabled             bool   `xml:"enabled,attr"`
+	Sources             string `xml:"sources,attr"`             // default "homeassistant,tasmota,zigbee2mqtt"
+	HomeAssistantPrefix string `xml:"homeAssistantPrefix,attr"` // default "homeassistant"
+	Zigbee2MQTTBase     string `xml:"zigbee2mqttBase,attr"`     // default "zigbee2mqtt"
 }
 
 type Device struct {
-	ID          string    `xml:"id,attr"`
-	Name        string    `xml:"name,attr"`
-	Category    string    `xml:"category,attr"`
-	StatusTopic string    `xml:"statusTopic"`
-	Controls    []Control `xml:"controls>control"`
+	ID           string         `xml:"id,attr"`
+	Name         string         `xml:"name,attr"`
+	Category     string         `xml:"category,attr"`
+	StatusTopics []StatusTopic  `xml:"statusTopic"`
+	Refresh      StatusRefresh  `xml:"refresh"`
+	Controls     []Control      `xml:"controls>control"`
+	Fields       []FieldMapping `xml:"fields>field"`
+	Availability Availability   `xml:"availability"`
+	Source       string         `xml:"-"` // discovery source; empty for configured devices
+	Members      []string       `xml:"-"` // member device IDs when this is a group
+}
+
+// Group is shown as a virtual device whose controls are those its members
+// share (same label and type). Using a control sets it on every member; the
+// group's status aggregates the members' control states.
+type Group struct {
+	ID        string `xml:"id,attr"`
+	Name      string `xml:"name,attr"`
+	Category  string `xml:"category,attr"`
+	Members   string `xml:"members,attr"`             // comma-separated device IDs
+	Aggregate string `xml:"aggregate,attr,omitempty"` // any (default) or all members on for a toggle to show on
+}
+
+// Availability marks a device offline when its availability (LWT) topic says
+// so, or when no status update arrived within the timeout.
+type Availability struct {
+	Topic          string `xml:"topic,attr,omitempty"`
+	PayloadOnline  string `xml:"payloadOnline,attr,omitempty"`  // default "online"
+	PayloadOffline string `xml:"payloadOffline,attr,omitempty"` // default "offline"
+	Timeout        int    `xml:"timeout,attr,omitempty"`        // seconds since the last status update
+}
+
+// MarshalXML leaves out an unset <availability> when a device is written to config
+func (a Availability) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if a == (Availability{}) {
+		return nil
+	}
+	type plain Availability
+	return e.EncodeElement(plain(a), start)
+}
+
+// StatusTopic is a topic filter (wildcards allowed) a device reports state
+// on. JSON objects are merged into the device status; with a field, the
+// payload is stored under that name instead, through the field mapping of
+// the same name if there is one.
+type StatusTopic struct {
+	Topic string `xml:",chardata"`
+	Field string `xml:"field,attr,omitempty"`
+}
+
+// FieldMapping extracts a named status field from a JSON payload. Without
+// any mappings, JSON objects are stored as received.
+type FieldMapping struct {
+	Name  string  `xml:"name,attr"`
+	Path  string  `xml:"path,attr"`            // e.g. "state.temperature", "sensors.0.value"; empty for the whole payload
+	Type  string  `xml:"type,attr,omitempty"`  // number, int, bool or string; default keeps the JSON type
+	Scale float64 `xml:"scale,attr,omitempty"` // multiplier for numeric values
+	Unit  string  `xml:"unit,attr,omitempty"`
+	Enum  string  `xml:"enum,attr,omitempty"` // raw:label pairs, e.g. "0:Off,1:Heat,2:Cool"
+}
+
+// StatusRefresh is published after connecting to ask a device for its state.
+type StatusRefresh struct {
+	Topic   string `xml:"topic,attr"`
+	Payload string `xml:"payload,attr"`
+}
+
+// MarshalXML leaves out an unset <refresh> when a device is written to config
+func (r StatusRefresh) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if r.Topic == "" {
+		return nil
+	}
+	type plain StatusRefresh
+	return e.EncodeElement(plain(r), start)
 }
 
 type Control struct {
-	Type         string `xml:"type,attr"` // button, slider, toggle
+	Type         string `xml:"type,attr"` // button, slider, toggle, color, select, number, text
 	Label        string `xml:"label,attr"`
 	Topic        string `xml:"topic,attr,omitempty"`
 	Payload      string `xml:"payload,attr,omitempty"`
 	LocalCommand string `xml:"localCommand,attr,omitempty"`
 	Min          int    `xml:"min,attr,omitempty"`
 	Max          int    `xml:"max,attr,omitempty"`
+
+	Step      float64         `xml:"step,attr,omitempty"`      // number: allowed increment from min
+	Unit      string          `xml:"unit,attr,omitempty"`      // number
+	ColorMode string          `xml:"colorMode,attr,omitempty"` // color: rgb (default), hsv or temp
+	Options   []ControlOption `xml:"option"`                   // select
+	MaxLength int             `xml:"maxLength,attr,omitempty"` // text
+	Pattern   string          `xml:"pattern,attr,omitempty"`   // text: regular expression the whole value must match
+
+	// Status field (a path such as "state" or "light.brightness") the
+	// control reflects, and for toggles the status values meaning on and off
+	StateField string `xml:"stateField,attr,omitempty"`
+	PayloadOn  string `xml:"payloadOn,attr,omitempty"`
+	PayloadOff string `xml:"payloadOff,attr,omitempty"`
+}
+
+// ControlOption is one choice of a select control; the label defaults to
+// the value.
+type ControlOption struct {
+	Value string `xml:"value,attr"`
+	Label string `xml:",chardata"`
 }
 
 type Category struct {
@@ -53,19 +191,199 @@ type Category struct {
 	Icon string `xml:"icon,attr"`
 }
 
+type Rule struct {
+	ID         string          `xml:"id,attr"`
+	Name       string          `xml:"name,attr"`
+	Disabled   bool            `xml:"disabled,attr"`
+	Trigger    RuleTrigger     `xml:"trigger"`
+	Conditions []RuleCondition `xml:"conditions>condition"`
+	Actions    []RuleAction    `xml:"actions>action"`
+}
+
+type RuleTrigger struct {
+	Device string `xml:"device,attr"`
+	For    int    `xml:"for,attr"` // seconds the conditions must hold before firing
+}
+
+type RuleCondition struct {
+	Device   string `xml:"device,attr,omitempty"` // defaults to the trigger device
+	Field    string `xml:"field,attr"`
+	Operator string `xml:"operator,attr"` // eq, ne, gt, gte, lt, lte, contains
+	Value    string `xml:"value,attr"`
+}
+
+type RuleAction struct {
+	Type         string `xml:"type,attr"` // mqtt, localCommand
+	Topic        string `xml:"topic,attr,omitempty"`
+	Payload      string `xml:"payload,attr,omitempty"`
+	Retain       bool   `xml:"retain,attr,omitempty"`
+	LocalCommand string `xml:"localCommand,attr,omitempty"`
+}
+
+type Location struct {
+	Latitude  float64 `xml:"latitude,attr"`
+	Longitude float64 `xml:"longitude,attr"`
+}
+
+type Schedule struct {
+	ID      string           `xml:"id,attr"`
+	Name    string           `xml:"name,attr"`
+	Cron    string           `xml:"cron,attr,omitempty"`   // 5-field cron expression
+	Sun     string           `xml:"sun,attr,omitempty"`    // sunrise, sunset
+	Offset  int              `xml:"offset,attr,omitempty"` // minutes relative to the sun event
+	Paused  bool             `xml:"paused,attr"`
+	Actions []ScheduleAction `xml:"actions>action"`
+}
+
+// ScheduleAction fires an existing device control (by device ID and control
+// label) or publishes an arbitrary MQTT message.
+type ScheduleAction struct {
+	Device  string `xml:"device,attr,omitempty"`
+	Control string `xml:"control,attr,omitempty"`
+	Value   string `xml:"value,attr,omitempty"` // slider position, toggle state or input value
+	Topic   string `xml:"topic,attr,omitempty"`
+	Payload string `xml:"payload,attr,omitempty"`
+	Retain  bool   `xml:"retain,attr,omitempty"`
+}
+
+// Scene runs its actions in order when activated, e.g. "Movie night".
+type Scene struct {
+	ID      string        `xml:"id,attr"`
+	Name    string        `xml:"name,attr"`
+	Icon    string        `xml:"icon,attr,omitempty"`
+	Actions []SceneAction `xml:"actions>action"`
+}
+
+// SceneAction is one step of a scene: a device control (with the value to
+// set for sliders, toggles and inputs), an MQTT publish, a local command, or
+// a delay before the next step.
+type SceneAction struct {
+	Device       string `xml:"device,attr,omitempty"`
+	Control      string `xml:"control,attr,omitempty"`
+	Value        string `xml:"value,attr,omitempty"`
+	Topic        string `xml:"topic,attr,omitempty"`
+	Payload      string `xml:"payload,attr,omitempty"`
+	Retain       bool   `xml:"retain,attr,omitempty"`
+	LocalCommand string `xml:"localCommand,attr,omitempty"`
+	Delay        int    `xml:"delay,attr,omitempty"` // milliseconds
+}
+
+type SceneInfo struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Icon    string `json:"icon,omitempty"`
+	Actions int    `json:"actions"`
+}
+
+type History struct {
+	Dir           string `xml:"dir,attr"`           // empty disables history
+	RetentionDays int    `xml:"retentionDays,attr"` // 0 = keep forever
+}
+
+// MQTTLogSpool keeps the MQTT log on disk, one file per day.
+type MQTTLogSpool struct {
+	Dir           string `xml:"dir,attr"`           // empty disables the spool
+	RetentionDays int    `xml:"retentionDays,attr"` // 0 = keep forever
+}
+
+// Publish configures the dashboard's publish console, enabled by allowPublish.
+type Publish struct {
+	File        string `xml:"file,attr"`        // saved snippets and history; empty keeps them in memory
+	HistorySize int    `xml:"historySize,attr"` // recent messages kept
+}
+
+// TopicTree records the last message on every topic for /api/topics.
+type TopicTree struct {
+	Enabled    bool `xml:"enabled,attr"`
+	MaxTopics  int  `xml:"maxTopics,attr"`  // default 10000; later topics are ignored
+	AllowClear bool `xml:"allowClear,attr"` // let admins clear retained messages
+}
+
+type State struct {
+	File      string `xml:"file,attr"`      // empty disables state persistence
+	SaveDelay int    `xml:"saveDelay,attr"` // seconds to coalesce updates before writing
+}
+
+// Auth is enabled when at least one user is configured.
+type Auth struct {
+	SessionTimeout int    `xml:"sessionTimeout,attr"` // minutes, default 720
+	SecureCookie   bool   `xml:"secureCookie,attr"`   // set when served over HTTPS
+	AllowedOrigins string `xml:"allowedOrigins,attr"` // comma-separated extra origins allowed on /ws
+	Roles          []Role `xml:"role"`
+	Users          []User `xml:"user"`
+}
+
+type User struct {
+	Name         string `xml:"name,attr"`
+	PasswordHash string `xml:"passwordHash,attr"`   // bcrypt, see -hash-password
+	Role         string `xml:"role,attr,omitempty"` // empty = unrestricted
+}
+
+// Role limits which devices and controls a user can see and operate. Deny
+// entries win over allow entries; empty allow lists allow everything.
+type Role struct {
+	ID    string    `xml:"id,attr"`
+	Admin bool      `xml:"admin,attr"`
+	Allow RoleRules `xml:"allow"`
+	Deny  RoleRules `xml:"deny"`
+}
+
+// RoleRules hold comma-separated device IDs, category IDs and control types.
+type RoleRules struct {
+	Devices      string `xml:"devices,attr"`
+	Categories   string `xml:"categories,attr"`
+	ControlTypes string `xml:"controlTypes,attr"`
+}
+
+type ScheduleInfo struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Trigger  string `json:"trigger"`
+	Paused   bool   `json:"paused"`
+	NextFire string `json:"nextFire,omitempty"`
+	LastFire string `json:"lastFire,omitempty"`
+}
+
 type MQTTLogEntry struct {
-	Timestamp string `json:"timestamp"`
-	Topic     string `json:"topic"`
-	Payload   string `json:"payload"`
+	Timestamp time.Time `json:"timestamp"`
+	Topic     string    `json:"topic"`
+	Payload   string    `json:"payload"`
+	QoS       byte      `json:"qos"`
+	Retain    bool      `json:"retain"`
+	Direction string    `json:"direction"` // "in" or "out"
+	Size      int       `json:"size"`      // payload size in bytes
+}
+
+// CommandResult records one local command execution. Running is true until
+// the command exits or times out.
+type CommandResult struct {
+	ID         string `json:"id"`
+	Command    string `json:"command"`
+	Device     string `json:"device,omitempty"`
+	Source     string `json:"source"`
+	Started    string `json:"started"`
+	DurationMs int64  `json:"durationMs"`
+	Running    bool   `json:"running"`
+	ExitCode   int    `json:"exitCode"`
+	TimedOut   bool   `json:"timedOut"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	Error      string `json:"error,omitempty"`
 }
 
 // Runtime structures
 type DeviceStatus struct {
-	ID       string                 `json:"id"`
-	Name     string                 `json:"name"`
-	Category string                 `json:"category"`
-	Status   map[string]interface{} `json:"status"`
-	Controls []Control              `json:"controls"`
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Category  string                 `json:"category"`
+	Status    map[string]interface{} `json:"status"`
+	Units     map[string]string      `json:"units,omitempty"`
+	Controls  []Control              `json:"controls"`
+	Available bool                   `json:"available"`
+
+	lastPayloads map[string]string // by topic, to skip replayed retained messages
+	lastSeen     time.Time         // last status update, or when tracking started
+	offline      bool              // reported offline on the availability topic
 }
 
 type SystemStats struct {
@@ -76,25 +394,55 @@ type SystemStats struct {
 	MemoryUsed  float64 `json:"memoryUsed"`
 	MemoryTotal float64 `json:"memoryTotal"`
 	CPUCount    int     `json:"cpuCount"`
+	WSClients   int     `json:"wsClients"`
+	WSDropped   uint64  `json:"wsDropped"` // messages dropped for slow WebSocket clients
 }
 
 type WebSocketMessage struct {
-	Type     string      `json:"type"`
-	DeviceID string      `json:"deviceId,omitempty"`
-	Data     interface{} `json:"data"`
+	Type     string                 `json:"type"`
+	DeviceID string                 `json:"deviceId,omitempty"`
+	Data     interface{}            `json:"data"`
+	Controls map[string]interface{} `json:"controls,omitempty"` // resolved control states by label
 }
 
 // Application state
 type App struct {
-	config       Config
-	mqttClient   mqtt.Client
-	deviceStatus map[string]*DeviceStatus
-	statusMutex  sync.RWMutex
-	wsClients    map[*websocket.Conn]bool
-	wsMutex      sync.RWMutex
-	wsUpgrader   websocket.Upgrader
-	templates    *template.Template
-	webDir       string
-	mqttLog      []MQTTLogEntry
-	mqttLogMutex sync.RWMutex
+	// Updated atomically, so kept first for 64-bit alignment on 32-bit ARM
+	wsDropped uint64 // messages dropped for slow WebSocket clients
+
+	config         Config
+	mqttClient     mqtt.Client
+	deviceStatus   map[string]*DeviceStatus
+	statusMutex    sync.RWMutex
+	wsClients      map[*wsClient]bool
+	wsMutex        sync.RWMutex
+	wsUpgrader     websocket.Upgrader
+	templates      *template.Template
+	webDir         string
+	mqttLog        mqttLogRing
+	mqttSpool      *historyStore
+	console        publishConsole
+	topicTree      *topicTree
+	logAllMQTT     bool
+	consoleMutex   sync.Mutex
+	mqttLogMutex   sync.RWMutex
+	ruleStates     map[string]*ruleState
+	rulesMutex     sync.Mutex
+	schedules      map[string]*scheduleState
+	scheduleMutex  sync.Mutex
+	history        *historyStore
+	stateSaveTimer *time.Timer
+	stateMutex     sync.Mutex
+	configEdits    sync.Mutex // serializes edits to the config file
+	configMutex    sync.RWMutex
+	configFile     string
+	watchedFiles   map[string]time.Time
+	sessions       map[string]*session
+	sessionMutex   sync.Mutex
+	commandLog     commandLogRing
+	commandMutex   sync.RWMutex
+	haTopics       map[string]bool // discovery topics currently published
+	haMutex        sync.Mutex
+	discovery      *discoveryState // nil unless discovery is enabled
+	devicesMutex   sync.Mutex      // serializes device list swaps and resubscription
 }
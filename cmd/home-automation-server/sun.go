@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// sunTimes returns sunrise and sunset for the calendar day of date at the
+// given coordinates, using the standard sunrise equation. ok is false during
+// polar day or polar night when the sun does not rise or set.
+func sunTimes(date time.Time, latitude, longitude float64) (sunrise, sunset time.Time, ok bool) {
+	const rad = math.Pi / 180
+
+	midnight := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	julianDate := float64(midnight.Unix())/86400 + 2440587.5
+
+	n := math.Ceil(julianDate - 2451545.0 + 0.0008)
+	meanSolarTime := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanSolarTime, 360)
+	center := 1.9148*math.Sin(anomaly*rad) + 0.02*math.Sin(2*anomaly*rad) + 0.0003*math.Sin(3*anomaly*rad)
+	eclipticLongitude := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := 2451545.0 + meanSolarTime + 0.0053*math.Sin(anomaly*rad) - 0.0069*math.Sin(2*eclipticLongitude*rad)
+
+	sinDeclination := math.Sin(eclipticLongitude*rad) * math.Sin(23.4397*rad)
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+	cosHourAngle := (math.Sin(-0.833*rad) - math.Sin(latitude*rad)*sinDeclination) /
+		(math.Cos(latitude*rad) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) / rad
+
+	toTime := func(jd float64) time.Time {
+		seconds := (jd - 2440587.5) * 86400
+		return time.Unix(int64(seconds), 0).In(date.Location())
+	}
+
+	return toTime(transit - hourAngle/360), toTime(transit + hourAngle/360), true
+}
+
+// nextSunEvent returns the first sunrise or sunset (plus offset) strictly
+// after t, or the zero time if none occurs within a year.
+func nextSunEvent(t time.Time, event string, offset time.Duration, latitude, longitude float64) time.Time {
+	for day := 0; day <= 366; day++ {
+		date := t.AddDate(0, 0, day)
+		sunrise, sunset, ok := sunTimes(date, latitude, longitude)
+		if !ok {
+			continue
+		}
+
+		at := sunset
+		if event == "sunrise" {
+			at = sunrise
+		}
+		at = at.Add(offset)
+		if at.After(t) {
+			return at
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Default broker ports for each supported connection scheme
+var mqttSchemePorts = map[string]int{
+	"tcp": 1883,
+	"ssl": 8883,
+	"ws":  80,
+	"wss": 443,
+}
+
+// mqttScheme normalizes the configured scheme to the names paho understands.
+func mqttScheme(scheme string) (string, error) {
+	switch strings.ToLower(scheme) {
+	case "", "tcp", "mqtt":
+		return "tcp", nil
+	case "ssl", "tls", "mqtts":
+		return "ssl", nil
+	case "ws":
+		return "ws", nil
+	case "wss":
+		return "wss", nil
+	}
+	return "", fmt.Errorf("unsupported MQTT scheme '%s' (use tcp, ssl, ws or wss)", scheme)
+}
+
+// mqttBrokerURL builds the broker address from the <mqtt> settings.
+func mqttBrokerURL(config MQTTConfig) (string, error) {
+	scheme, err := mqttScheme(config.Scheme)
+	if err != nil {
+		return "", err
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = mqttSchemePorts[scheme]
+	}
+
+	broker := fmt.Sprintf("%s://%s:%d", scheme, config.Broker, port)
+	if scheme == "ws" || scheme == "wss" {
+		path := config.Path
+		if path == "" {
+			path = "/mqtt"
+		}
+		broker += "/" + strings.TrimPrefix(path, "/")
+	}
+	return broker, nil
+}
+
+// mqttTLSConfig returns the TLS settings for ssl:// and wss:// connections,
+// or nil when the connection is not encrypted.
+func mqttTLSConfig(config MQTTConfig) (*tls.Config, error) {
+	scheme, err := mqttScheme(config.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	if scheme != "ssl" && scheme != "wss" {
+		if config.CAFile != "" || config.CertFile != "" {
+			return nil, fmt.Errorf("caFile and certFile require the ssl or wss scheme")
+		}
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file '%s': %v", config.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file '%s'", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("client certificates need both certFile and keyFile")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	for _, proto := range strings.Split(config.ALPN, ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, proto)
+		}
+	}
+
+	return tlsConfig, nil
+}
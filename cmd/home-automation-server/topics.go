@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// statusBinding ties a device to one of its status topic filters.
+type statusBinding struct {
+	deviceID string
+	filter   StatusTopic
+}
+
+// validateStatusTopics also keeps each subscription to one owner: the MQTT
+// client keeps a single handler per filter, so a filter shared between
+// devices, or with an availability topic, would starve one of them.
+func validateStatusTopics(config *Config) error {
+	owners := make(map[string]string)
+	for _, device := range config.Devices {
+		seen := make(map[string]bool)
+		for i := range device.StatusTopics {
+			// Only write when trimming changes something; devices already
+			// in use are revalidated when discovered devices are merged
+			if trimmed := strings.TrimSpace(device.StatusTopics[i].Topic); trimmed != device.StatusTopics[i].Topic {
+				device.StatusTopics[i].Topic = trimmed
+			}
+			statusTopic := device.StatusTopics[i]
+			if err := validateTopicFilter(statusTopic.Topic); err != nil {
+				return fmt.Errorf("device '%s': status topic '%s': %v", device.ID, statusTopic.Topic, err)
+			}
+			if seen[statusTopic.Topic] {
+				return fmt.Errorf("device '%s': duplicate status topic '%s'", device.ID, statusTopic.Topic)
+			}
+			seen[statusTopic.Topic] = true
+			if owner, exists := owners[statusTopic.Topic]; exists {
+				return fmt.Errorf("device '%s': status topic '%s' is already used by device '%s'", device.ID, statusTopic.Topic, owner)
+			}
+			owners[statusTopic.Topic] = device.ID
+			if statusTopic.Field != "" && !fieldNamePattern.MatchString(statusTopic.Field) {
+				return fmt.Errorf("device '%s': status topic '%s': field must be letters, digits, '_' or '-'", device.ID, statusTopic.Topic)
+			}
+		}
+	}
+	for _, device := range config.Devices {
+		if owner, exists := owners[device.Availability.Topic]; exists {
+			return fmt.Errorf("device '%s': availability topic '%s' is a status topic of device '%s'", device.ID, device.Availability.Topic, owner)
+		}
+	}
+	return nil
+}
+
+// validateTopicFilter checks that '+' and '#' only appear as whole levels and
+// that '#' is last.
+func validateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty topic")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "+" || (level == "#" && i == len(levels)-1) {
+			continue
+		}
+		if strings.ContainsAny(level, "+#") {
+			return fmt.Errorf("wildcards must occupy a whole level and '#' must be last")
+		}
+	}
+	return nil
+}
+
+// topicMatches reports whether topic matches an MQTT subscription filter.
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	// Wildcards at the first level don't match topics starting with '$'
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// topicSpecificity ranks filters so an exact topic beats any wildcard and
+// '+' beats '#'. Filters are only compared for topics they both match.
+func topicSpecificity(filter string) int {
+	score := 1
+	for _, level := range strings.Split(filter, "/") {
+		switch level {
+		case "#":
+			score--
+		case "+":
+			score += 2
+		default:
+			score += 4
+		}
+	}
+	return score
+}
+
+// resolveStatusTopic picks the binding a status message on topic belongs to:
+// the most specific matching filter. Validation keeps filters unique, so
+// equally specific matches are different filters, such as a/+ and +/b; the
+// first configured device wins those.
+func resolveStatusTopic(devices []Device, topic string) (statusBinding, bool) {
+	var best statusBinding
+	bestScore := -1
+	for _, device := range devices {
+		for _, statusTopic := range device.StatusTopics {
+			if !topicMatches(statusTopic.Topic, topic) {
+				continue
+			}
+			if score := topicSpecificity(statusTopic.Topic); score > bestScore {
+				best = statusBinding{deviceID: device.ID, filter: statusTopic}
+				bestScore = score
+			}
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// statusTopicOwners maps each status topic filter to the devices using it,
+// so reloads can tell which subscriptions changed.
+func statusTopicOwners(devices []Device) map[string]string {
+	owners := make(map[string][]string)
+	for _, device := range devices {
+		for _, statusTopic := range device.StatusTopics {
+			owners[statusTopic.Topic] = append(owners[statusTopic.Topic], device.ID+":"+statusTopic.Field)
+		}
+	}
+
+	joined := make(map[string]string, len(owners))
+	for filter, ids := range owners {
+		sort.Strings(ids)
+		joined[filter] = strings.Join(ids, ",")
+	}
+	return joined
+}
+
+// hasStatusTopic reports whether topic matches one of the device's status
+// topic filters.
+func (device Device) hasStatusTopic(topic string) bool {
+	for _, statusTopic := range device.StatusTopics {
+		if topicMatches(statusTopic.Topic, topic) {
+			return true
+		}
+	}
+	return false
+}
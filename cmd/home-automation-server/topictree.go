@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// topicTree records the last message seen on every topic, one node per topic
+// level, so stale retained messages can be found and cleared.
+type topicTree struct {
+	mutex     sync.RWMutex
+	root      *topicNode
+	count     int // topics that have received a message
+	maxTopics int
+	full      bool // maxTopics was reached and new topics are being ignored
+}
+
+type topicNode struct {
+	children map[string]*topicNode
+	seen     bool // a message arrived on this exact topic
+	payload  string
+	qos      byte
+	retained bool
+	updated  time.Time
+	messages int
+}
+
+// TopicInfo is a node of the topic tree as returned by /api/topics.
+type TopicInfo struct {
+	Name      string      `json:"name"`
+	Topic     string      `json:"topic"`
+	Payload   *string     `json:"payload,omitempty"` // nil when no message arrived on this exact topic
+	QoS       byte        `json:"qos"`
+	Retained  bool        `json:"retained"`
+	Timestamp string      `json:"timestamp,omitempty"`
+	Messages  int         `json:"messages"`
+	Topics    int         `json:"topics"`         // topics with messages in this subtree
+	Retains   int         `json:"retainedTopics"` // retained topics in this subtree
+	Children  []TopicInfo `json:"children,omitempty"`
+}
+
+func newTopicTree(maxTopics int) *topicTree {
+	return &topicTree{
+		root:      &topicNode{},
+		maxTopics: maxTopics,
+	}
+}
+
+// record stores a message. Retained is only reported by the broker for
+// messages replayed on subscribe, so a live message leaves the flag as is
+// unless its payload is empty, which clears a retained message.
+func (t *topicTree) record(topic, payload string, qos byte, retained bool, at time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	node := t.root
+	for _, level := range strings.Split(topic, "/") {
+		child, exists := node.children[level]
+		if !exists {
+			if t.count >= t.maxTopics {
+				if !t.full {
+					log.Printf("Topic tree: %d topics recorded, ignoring new topics", t.maxTopics)
+					t.full = true
+				}
+				return
+			}
+			if node.children == nil {
+				node.children = make(map[string]*topicNode)
+			}
+			child = &topicNode{}
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	if !node.seen {
+		node.seen = true
+		t.count++
+	}
+	node.payload = payload
+	node.qos = qos
+	node.updated = at
+	node.messages++
+	if retained || payload == "" {
+		node.retained = retained && payload != ""
+	}
+}
+
+// find returns the node for topic, or the root for an empty topic.
+func (t *topicTree) find(topic string) *topicNode {
+	node := t.root
+	if topic == "" {
+		return node
+	}
+	for _, level := range strings.Split(topic, "/") {
+		node = node.children[level]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// info describes node and its descendants up to depth levels down (negative
+// for all), leaving out topics visible rejects; the counts cover the whole
+// subtree. ok is false if nothing under node is visible.
+func (t *topicTree) info(node *topicNode, name, topic string, depth int, visible func(topic string) bool) (TopicInfo, bool) {
+	info := TopicInfo{Name: name, Topic: topic}
+	ok := false
+	if node.seen && node != t.root && visible(topic) {
+		payload := node.payload
+		info.Payload = &payload
+		info.QoS = node.qos
+		info.Retained = node.retained
+		info.Timestamp = node.updated.Format(time.RFC3339)
+		info.Messages = node.messages
+		info.Topics = 1
+		if node.retained {
+			info.Retains = 1
+		}
+		ok = true
+	}
+
+	names := make([]string, 0, len(node.children))
+	for childName := range node.children {
+		names = append(names, childName)
+	}
+	sort.Strings(names)
+	for _, childName := range names {
+		childTopic := childName
+		if node != t.root {
+			childTopic = topic + "/" + childName
+		}
+		child, childOK := t.info(node.children[childName], childName, childTopic, depth-1, visible)
+		if !childOK {
+			continue
+		}
+		ok = true
+		info.Topics += child.Topics
+		info.Retains += child.Retains
+		if depth != 0 {
+			info.Children = append(info.Children, child)
+		}
+	}
+	return info, ok
+}
+
+// retainedTopics lists the topics under node holding a retained message,
+// only node itself unless subtree is set.
+func (t *topicTree) retainedTopics(node *topicNode, topic string, subtree bool) []string {
+	var topics []string
+	if node.retained && node != t.root {
+		topics = append(topics, topic)
+	}
+	if !subtree {
+		return topics
+	}
+	for name, child := range node.children {
+		childTopic := name
+		if node != t.root {
+			childTopic = topic + "/" + name
+		}
+		topics = append(topics, t.retainedTopics(child, childTopic, true)...)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// subscribeToAllMessages subscribes to every topic, feeding the topic tree
+// and, with -log-all-mqtt, the MQTT log. Both share one subscription since a
+// second subscription to '#' would replace the first one's handler.
+func (app *App) subscribeToAllMessages() {
+	if app.topicTree == nil && !app.logAllMQTT {
+		return
+	}
+
+	token := app.mqttClient.Subscribe("#", 0, func(client mqtt.Client, msg mqtt.Message) {
+		if app.topicTree != nil {
+			app.topicTree.record(msg.Topic(), string(msg.Payload()), msg.Qos(), msg.Retained(), time.Now())
+		}
+		if app.logAllMQTT {
+			app.logMQTTMessage(msg)
+		}
+	})
+
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Failed to subscribe to wildcard topic: %v", token.Error())
+	} else {
+		log.Printf("Subscribed to wildcard topic for MQTT logging and the topic tree")
+	}
+}
+
+// handleTopics returns the topic tree under topic (GET ?topic=&depth=, depth
+// limiting the levels returned) or clears retained messages (DELETE
+// ?topic=&subtree=true) by publishing empty retained payloads. Clearing is
+// disabled unless the config sets allowClear="true" and is limited to admin
+// users.
+func (app *App) handleTopics(w http.ResponseWriter, r *http.Request) {
+	if app.topicTree == nil {
+		http.Error(w, "The topic tree is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	topic := query.Get("topic")
+	config := app.getConfig()
+	userAccess := app.accessFor(r)
+
+	switch r.Method {
+	case "GET":
+		depth := -1
+		if s := query.Get("depth"); s != "" {
+			var err error
+			if depth, err = strconv.Atoi(s); err != nil || depth < 0 {
+				http.Error(w, "Invalid 'depth'", http.StatusBadRequest)
+				return
+			}
+		}
+
+		app.topicTree.mutex.RLock()
+		node := app.topicTree.find(topic)
+		var info TopicInfo
+		found := false
+		if node != nil {
+			name := topic[strings.LastIndex(topic, "/")+1:]
+			info, found = app.topicTree.info(node, name, topic, depth, func(topic string) bool {
+				return userAccess.canSeeTopic(&config, topic)
+			})
+		}
+		app.topicTree.mutex.RUnlock()
+
+		if !found && topic != "" {
+			http.Error(w, "Topic not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+
+	case "DELETE":
+		if !config.TopicTree.AllowClear {
+			http.Error(w, "Clearing retained messages is disabled", http.StatusForbidden)
+			return
+		}
+		if !userAccess.isAdmin() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		// Clearing from the root would wipe every retained message on the broker
+		if topic == "" {
+			http.Error(w, "A topic is required", http.StatusBadRequest)
+			return
+		}
+
+		app.topicTree.mutex.RLock()
+		var topics []string
+		if node := app.topicTree.find(topic); node != nil {
+			topics = app.topicTree.retainedTopics(node, topic, query.Get("subtree") == "true")
+		}
+		app.topicTree.mutex.RUnlock()
+
+		cleared := make([]string, 0, len(topics))
+		for _, retainedTopic := range topics {
+			if err := app.publishMQTT(retainedTopic, "", true); err != nil {
+				log.Printf("Failed to clear retained message on %s: %v", retainedTopic, err)
+				continue
+			}
+			cleared = append(cleared, retainedTopic)
+		}
+		log.Printf("%s cleared %d retained messages under '%s'", userAccess.user, len(cleared), topic)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"cleared": cleared})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -13,8 +13,6 @@ import (
 )
 
 func (app *App) loadTemplates() error {
-	var err error
-
 	// Create template with custom functions
 	funcMap := template.FuncMap{
 		"safeAttr": func(s string) string {
@@ -29,32 +27,54 @@ func (app *App) loadTemplates() error {
 	// Parse all HTML templates from the templates directory
 	templateDir := filepath.Join(app.webDir, "templates")
 	templatePattern := filepath.Join(templateDir, "*.html")
-	app.templates, err = template.New("").Funcs(funcMap).ParseGlob(templatePattern)
+	templates, err := template.New("").Funcs(funcMap).ParseGlob(templatePattern)
 	if err != nil {
 		return fmt.Errorf("failed to parse templates from '%s': %v", templateDir, err)
 	}
 
+	app.configMutex.Lock()
+	app.templates = templates
+	app.configMutex.Unlock()
+
 	log.Printf("Loaded templates from: %s", templateDir)
-	log.Printf("Available templates: %v", app.templates.DefinedTemplates())
+	log.Printf("Available templates: %v", templates.DefinedTemplates())
 	return nil
 }
 
 func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) {
+	config := app.getConfig()
+	userAccess := app.accessFor(r)
+	devices := userAccess.filterDevices(append(append([]Device(nil), config.Devices...), config.groupDevices()...))
+
 	data := struct {
 		Config     Config
 		Categories []Category
 		Devices    []Device
+		Scenes     []SceneInfo
 		Title      string
 		ID         string
+		User       string
+		CSRFToken  string
+		IsAdmin    bool
 	}{
-		Config:     app.config,
-		Categories: app.config.Categories,
-		Devices:    app.config.Devices,
+		Config:     config,
+		Categories: userAccess.filterCategories(config.Categories, devices),
+		Devices:    devices,
+		Scenes:     app.getSceneInfo(userAccess),
 		Title:      "Home Automation Control",
 		ID:         uuid.NewString(),
+		IsAdmin:    userAccess.isAdmin(),
 	}
+	if s := sessionFromRequest(r); s != nil {
+		data.User = s.user
+		data.CSRFToken = s.csrfToken
+	}
+
+	app.configMutex.RLock()
+	templates := app.templates
+	app.configMutex.RUnlock()
 
-	if err := app.templates.ExecuteTemplate(w, "index.html", data); err != nil {
+	if err := templates.ExecuteTemplate(w, "index.html", data); err != nil {
 		log.Printf("Template execution error: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
@@ -67,45 +87,73 @@ func (app *App) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		log.Printf("WebSocket upgrade error: %v", err)
 		return
 	}
-	defer conn.Close()
 
-	app.wsMutex.Lock()
-	app.wsClients[conn] = true
-	app.wsMutex.Unlock()
-
-	// Send initial status to new client
-	app.statusMutex.RLock()
-	for deviceID, status := range app.deviceStatus {
-		message := WebSocketMessage{
-			Type:     "status_update",
-			DeviceID: deviceID,
-			Data:     status.Status,
+	var user, token string
+	if s := sessionFromRequest(r); s != nil {
+		user = s.user
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			token = cookie.Value
 		}
-		conn.WriteJSON(message)
 	}
-	app.statusMutex.RUnlock()
 
-	// Send initial MQTT log to new client
-	app.mqttLogMutex.RLock()
-	for _, entry := range app.mqttLog {
-		message := WebSocketMessage{
-			Type: "mqtt_log",
-			Data: entry,
-		}
-		conn.WriteJSON(message)
-	}
-	app.mqttLogMutex.RUnlock()
-
-	// Keep connection alive
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			app.wsMutex.Lock()
-			delete(app.wsClients, conn)
-			app.wsMutex.Unlock()
-			break
+	// Register before taking the snapshot so no update is missed; the
+	// client holds broadcasts until the snapshot is queued ahead of them
+	client := newWSClient(conn, user, token)
+	app.registerClient(client)
+	defer app.unregisterClient(client)
+	client.queueSnapshot(app.snapshot(client))
+	go client.writePump()
+
+	client.readPump(func(data []byte) {
+		app.handleClientMessage(client, data)
+	})
+}
+
+// controlRequest names a configured control. The topic, payload and local
+// command always come from the server's config, never from the request.
+type controlRequest struct {
+	Device  string      `json:"device"`
+	Control *int        `json:"control"` // index into the device's controls
+	Label   string      `json:"label"`   // alternatively, the control label
+	Value   interface{} `json:"value"`   // slider position, toggle state or input value
+}
+
+// sendControl runs a control request on behalf of a user. On failure it
+// returns the HTTP status that describes the error.
+func (app *App) sendControl(userAccess *access, req controlRequest) (string, int, error) {
+	config := app.getConfig()
+	device, exists := config.findDevice(req.Device)
+	if !exists {
+		return "", http.StatusNotFound, fmt.Errorf("Unknown device")
+	}
+
+	var control Control
+	if req.Control != nil {
+		if *req.Control < 0 || *req.Control >= len(device.Controls) {
+			return "", http.StatusNotFound, fmt.Errorf("Unknown control")
 		}
+		control = device.Controls[*req.Control]
+	} else if control, exists = config.findControl(device.ID, req.Label); !exists {
+		return "", http.StatusNotFound, fmt.Errorf("Unknown control")
+	}
+
+	if !userAccess.canOperate(&config, device, control) {
+		log.Printf("Denied control request from %s for %s/%s", userAccess.user, device.ID, control.Label)
+		return "", http.StatusForbidden, fmt.Errorf("Forbidden")
+	}
+
+	if _, err := controlValue(control, req.Value); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+
+	log.Printf("Received control request: Device=%s, Control=%s, Value=%v", device.ID, control.Label, req.Value)
+
+	commandID, err := app.runControl(device, control, req.Value, userAccess.user, "user "+userAccess.user)
+	if err != nil {
+		log.Printf("Failed to send control %s/%s: %v", device.ID, control.Label, err)
+		return "", http.StatusInternalServerError, fmt.Errorf("Failed to send command")
 	}
+	return commandID, http.StatusOK, nil
 }
 
 func (app *App) handleControl(w http.ResponseWriter, r *http.Request) {
@@ -114,57 +162,38 @@ func (app *App) handleControl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		Device       string `json:"device"`
-		Topic        string `json:"topic"`
-		Payload      string `json:"payload"`
-		LocalCommand string `json:"localCommand"`
-	}
-
+	var req controlRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Received control request: Device=%s, Topic=%s, Payload=%s, LocalCommand=%s",
-		req.Device, req.Topic, req.Payload, req.LocalCommand)
-
-	// Execute local command if specified
-	if req.LocalCommand != "" {
-		go app.executeLocalCommand(req.LocalCommand)
-	}
-
-	// Send MQTT command if topic is specified
-	if req.Topic != "" {
-		token := app.mqttClient.Publish(req.Topic, 1, false, req.Payload)
-		if token.Wait() && token.Error() != nil {
-			log.Printf("Failed to publish MQTT message: %v", token.Error())
-			http.Error(w, "Failed to send MQTT command", http.StatusInternalServerError)
-			return
-		}
-		log.Printf("Sent MQTT command - Topic: %s, Payload: %s", req.Topic, req.Payload)
-
-		// Log the outgoing message
-		app.addMQTTLogEntry(req.Topic+" (OUT)", req.Payload)
+	commandID, status, err := app.sendControl(app.accessFor(r), req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"commandId": commandID})
 }
 
 func (app *App) handleStatus(w http.ResponseWriter, r *http.Request) {
+	config := app.getConfig()
+	userAccess := app.accessFor(r)
+
 	app.statusMutex.RLock()
 	defer app.statusMutex.RUnlock()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(app.deviceStatus)
-}
-
-func (app *App) handleMQTTLog(w http.ResponseWriter, r *http.Request) {
-	app.mqttLogMutex.RLock()
-	defer app.mqttLogMutex.RUnlock()
+	visible := make(map[string]*DeviceStatus, len(app.deviceStatus))
+	for deviceID, deviceStatus := range app.deviceStatus {
+		if device, _ := config.findDevice(deviceID); userAccess.canSeeDevice(device) {
+			visible[deviceID] = deviceStatus
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(app.mqttLog)
+	json.NewEncoder(w).Encode(visible)
 }
 
 func (app *App) handleSystemStats(w http.ResponseWriter, r *http.Request) {
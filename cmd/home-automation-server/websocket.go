@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsSendQueueSize = 256              // messages buffered per client before it is considered slow
+	wsWriteWait     = 10 * time.Second // time allowed to write one message
+	wsPongWait      = 60 * time.Second // time allowed between pongs from the client
+	wsPingPeriod    = wsPongWait * 9 / 10
+	wsMaxReadSize   = 4096
+)
+
+// wsClient is one dashboard connection. Only its writer goroutine writes to
+// the connection; everyone else queues messages on send.
+type wsClient struct {
+	conn      *websocket.Conn
+	user      string
+	session   string // session token, empty when auth is disabled
+	send      chan WebSocketMessage
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Until the initial snapshot is queued, broadcasts wait in held so
+	// they are sent after it rather than overtaken by older state
+	queueMutex sync.Mutex
+	holding    bool
+	held       []WebSocketMessage
+
+	subMutex sync.Mutex
+	sub      wsSubscription
+}
+
+// wsSubscription narrows what a client is sent. A nil set means everything
+// of that kind; once a client subscribes, only matching messages are sent.
+type wsSubscription struct {
+	devices    map[string]bool // device IDs, or "*" for all devices
+	categories map[string]bool
+	topics     map[string]bool // MQTT log topic filters
+}
+
+// wsRequest is a message from a client. Setting a list in subscribe or
+// unsubscribe, even to an empty one, switches that kind to explicit
+// subscriptions.
+type wsRequest struct {
+	Type       string   `json:"type"` // subscribe, unsubscribe, snapshot or control
+	ID         string   `json:"id"`   // echoed back in the reply
+	Devices    []string `json:"devices"`
+	Categories []string `json:"categories"`
+	Topics     []string `json:"topics"`
+	controlRequest
+}
+
+// wsReply acknowledges a client request.
+type wsReply struct {
+	ID        string `json:"id,omitempty"`
+	CommandID string `json:"commandId,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func newWSClient(conn *websocket.Conn, user, session string) *wsClient {
+	return &wsClient{
+		conn:    conn,
+		user:    user,
+		session: session,
+		done:    make(chan struct{}),
+		holding: true,
+	}
+}
+
+// queue adds a message without blocking. It returns false when the queue is
+// full or the client has gone away.
+func (c *wsClient) queue(message WebSocketMessage) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	if c.holding {
+		if len(c.held) >= wsSendQueueSize {
+			return false
+		}
+		c.held = append(c.held, message)
+		return true
+	}
+	select {
+	case c.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueSnapshot queues the initial snapshot followed by the messages held
+// while it was taken. The queue is sized to hold them all, and it must be
+// called before writePump starts.
+func (c *wsClient) queueSnapshot(snapshot []WebSocketMessage) {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	c.send = make(chan WebSocketMessage, len(snapshot)+len(c.held)+wsSendQueueSize)
+	for _, message := range snapshot {
+		c.send <- message
+	}
+	for _, message := range c.held {
+		c.send <- message
+	}
+	c.holding = false
+	c.held = nil
+}
+
+// deliver adds a message, waiting for room in the queue. It is used for the
+// initial snapshot, which may be larger than the queue.
+func (c *wsClient) deliver(message WebSocketMessage) bool {
+	select {
+	case c.send <- message:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// writePump sends queued messages and keepalive pings until the client is
+// closed or a write fails.
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.close()
+	}()
+
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(message); err != nil {
+				log.Printf("Error sending %s WebSocket message to %s: %v", message.Type, c.conn.RemoteAddr(), err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// readPump passes each client message to handle, keeping the read deadline
+// moving while pongs arrive. It returns when the connection fails or the
+// client stops answering pings.
+func (c *wsClient) readPump(handle func(data []byte)) {
+	c.conn.SetReadLimit(wsMaxReadSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		handle(data)
+	}
+}
+
+// updateSubscription adds (or with remove, drops) the request's devices,
+// categories and topic filters.
+func (c *wsClient) updateSubscription(req wsRequest, remove bool) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	update := func(set map[string]bool, values []string) map[string]bool {
+		if values == nil {
+			return set
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		for _, value := range values {
+			if remove {
+				delete(set, value)
+			} else {
+				set[value] = true
+			}
+		}
+		return set
+	}
+	c.sub.devices = update(c.sub.devices, req.Devices)
+	c.sub.categories = update(c.sub.categories, req.Categories)
+	c.sub.topics = update(c.sub.topics, req.Topics)
+}
+
+func (c *wsClient) wantsDevice(device Device) bool {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	if c.sub.devices == nil && c.sub.categories == nil {
+		return true
+	}
+	return c.sub.devices["*"] || c.sub.devices[device.ID] || c.sub.categories[device.Category]
+}
+
+func (c *wsClient) wantsTopic(topic string) bool {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	if c.sub.topics == nil {
+		return true
+	}
+	for filter := range c.sub.topics {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// wants reports whether message falls within the client's subscriptions.
+// Messages about neither a device nor a topic are always sent.
+func (c *wsClient) wants(config *Config, message WebSocketMessage) bool {
+	if entry, ok := message.Data.(MQTTLogEntry); ok {
+		return c.wantsTopic(entry.Topic)
+	}
+	if message.DeviceID != "" {
+		device, _ := config.findDevice(message.DeviceID)
+		if device.ID == "" {
+			device.ID = message.DeviceID
+		}
+		return c.wantsDevice(device)
+	}
+	return true
+}
+
+func (app *App) registerClient(client *wsClient) {
+	app.wsMutex.Lock()
+	app.wsClients[client] = true
+	app.wsMutex.Unlock()
+}
+
+func (app *App) unregisterClient(client *wsClient) {
+	app.wsMutex.Lock()
+	delete(app.wsClients, client)
+	app.wsMutex.Unlock()
+	client.close()
+}
+
+// closeSessionClients disconnects the clients opened with a session that
+// has ended.
+func (app *App) closeSessionClients(token string) {
+	var clients []*wsClient
+	app.wsMutex.RLock()
+	for client := range app.wsClients {
+		if client.session == token {
+			clients = append(clients, client)
+		}
+	}
+	app.wsMutex.RUnlock()
+
+	for _, client := range clients {
+		log.Printf("Closing WebSocket client %s: session ended", client.conn.RemoteAddr())
+		app.unregisterClient(client)
+	}
+}
+
+// clientAccess returns the client's access, checking that its session is
+// still live. ok is false once the session has ended.
+func (app *App) clientAccess(client *wsClient) (userAccess *access, ok bool) {
+	config := app.getConfig()
+	if !authEnabled(&config) {
+		return nil, true
+	}
+	s := app.findSession(&config, client.session)
+	if s == nil {
+		return nil, false
+	}
+	return accessForUser(&config, s.user), true
+}
+
+// broadcastTo queues message for every client whose access passes allowed,
+// or for all clients when allowed is nil, skipping clients that have not
+// subscribed to it. Clients whose queue is full are disconnected.
+func (app *App) broadcastTo(message WebSocketMessage, allowed func(a *access) bool) {
+	config := app.getConfig()
+
+	var slow []*wsClient
+	app.wsMutex.RLock()
+	for client := range app.wsClients {
+		if allowed != nil && !allowed(accessForUser(&config, client.user)) {
+			continue
+		}
+		if !client.wants(&config, message) {
+			continue
+		}
+		if !client.queue(message) {
+			slow = append(slow, client)
+		}
+	}
+	app.wsMutex.RUnlock()
+
+	for _, client := range slow {
+		app.dropSlowClient(client, message)
+	}
+}
+
+// dropSlowClient counts a message the client could not take and disconnects
+// it; it reconnects and receives a fresh snapshot.
+func (app *App) dropSlowClient(client *wsClient, message WebSocketMessage) {
+	select {
+	case <-client.done:
+		// Already disconnected; its handler unregisters it
+		return
+	default:
+	}
+	atomic.AddUint64(&app.wsDropped, 1)
+	log.Printf("Dropping slow WebSocket client %s (%s message)", client.conn.RemoteAddr(), message.Type)
+	app.unregisterClient(client)
+}
+
+func (app *App) broadcastMessage(message WebSocketMessage) {
+	app.broadcastTo(message, nil)
+}
+
+func (app *App) wsClientCount() int {
+	app.wsMutex.RLock()
+	defer app.wsMutex.RUnlock()
+	return len(app.wsClients)
+}
+
+// snapshot collects the current state the client may see and has subscribed
+// to: device status, unavailable devices, the MQTT log and schedules.
+func (app *App) snapshot(client *wsClient) []WebSocketMessage {
+	config := app.getConfig()
+	userAccess := accessForUser(&config, client.user)
+
+	var messages []WebSocketMessage
+	app.statusMutex.RLock()
+	for deviceID, status := range app.deviceStatus {
+		device, _ := config.findDevice(deviceID)
+		if !userAccess.canSeeDevice(device) || !client.wantsDevice(device) {
+			continue
+		}
+		messages = append(messages, WebSocketMessage{
+			Type:     "status_update",
+			DeviceID: deviceID,
+			Data:     status.Status,
+			Controls: controlStates(device, status.Status),
+		})
+	}
+	for deviceID, status := range app.deviceStatus {
+		if status.Available {
+			continue
+		}
+		device, _ := config.findDevice(deviceID)
+		if !userAccess.canSeeDevice(device) || !client.wantsDevice(device) {
+			continue
+		}
+		messages = append(messages, WebSocketMessage{
+			Type:     "availability",
+			DeviceID: deviceID,
+			Data:     map[string]bool{"available": false},
+		})
+	}
+	app.statusMutex.RUnlock()
+
+	app.mqttLogMutex.RLock()
+	app.mqttLog.each(func(entry MQTTLogEntry) bool {
+		if userAccess.canSeeTopic(&config, entry.Topic) && client.wantsTopic(entry.Topic) {
+			messages = append(messages, WebSocketMessage{
+				Type: "mqtt_log",
+				Data: entry,
+			})
+		}
+		return true
+	})
+	app.mqttLogMutex.RUnlock()
+
+	messages = append(messages, WebSocketMessage{
+		Type: "schedules",
+		Data: app.getScheduleInfo(),
+	})
+	return messages
+}
+
+// sendSnapshot queues the client's snapshot, waiting for room in its queue.
+func (app *App) sendSnapshot(client *wsClient) {
+	for _, message := range app.snapshot(client) {
+		if !client.deliver(message) {
+			return
+		}
+	}
+}
+
+// handleClientMessage carries out a request sent over the WebSocket. Each
+// request is answered with a reply message of the same type plus "_result".
+func (app *App) handleClientMessage(client *wsClient, data []byte) {
+	var req wsRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		app.replyTo(client, "error", wsReply{Error: "Invalid JSON"})
+		return
+	}
+
+	reply := wsReply{ID: req.ID}
+	switch req.Type {
+	case "subscribe", "unsubscribe":
+		for _, filter := range req.Topics {
+			if err := validateTopicFilter(filter); err != nil {
+				reply.Error = fmt.Sprintf("topic '%s': %v", filter, err)
+				app.replyTo(client, req.Type+"_result", reply)
+				return
+			}
+		}
+		client.updateSubscription(req, req.Type == "unsubscribe")
+	case "snapshot":
+		app.sendSnapshot(client)
+	case "control":
+		userAccess, ok := app.clientAccess(client)
+		if !ok {
+			// findSession has already closed the connection
+			return
+		}
+		commandID, _, err := app.sendControl(userAccess, req.controlRequest)
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		reply.CommandID = commandID
+	default:
+		reply.Error = fmt.Sprintf("unknown request type '%s'", req.Type)
+		app.replyTo(client, "error", reply)
+		return
+	}
+	app.replyTo(client, req.Type+"_result", reply)
+}
+
+func (app *App) replyTo(client *wsClient, replyType string, reply wsReply) {
+	message := WebSocketMessage{Type: replyType, Data: reply}
+	if !client.queue(message) {
+		app.dropSlowClient(client, message)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"encoding/xml"
 	"flag"
@@ -49,6 +51,12 @@ type Config struct {
 	ClientID    string
 	ConfigFile  string
 	Commands    map[string]string // map of command name to command string
+	CAFile      string
+	CertFile    string
+	KeyFile     string
+	Insecure    bool
+	ALPN        string
+	WSPath      string
 }
 
 func parseArgs() *Config {
@@ -60,12 +68,20 @@ func parseArgs() *Config {
 	flag.StringVar(&config.Username, "u", "", "MQTT username (optional)")
 	flag.StringVar(&config.Password, "p", "", "MQTT password (optional)")
 	flag.StringVar(&config.ClientID, "client-id", "", "MQTT client ID (optional, will be generated if not provided)")
+	flag.StringVar(&config.CAFile, "cafile", "", "CA certificate file for mqtts:// and wss:// (optional, system roots by default)")
+	flag.StringVar(&config.CertFile, "cert", "", "Client certificate file for mutual TLS (optional)")
+	flag.StringVar(&config.KeyFile, "key", "", "Client private key file for mutual TLS (optional)")
+	flag.BoolVar(&config.Insecure, "insecure", false, "Skip broker certificate verification")
+	flag.StringVar(&config.ALPN, "alpn", "", "Comma-separated ALPN protocols to offer (optional)")
+	flag.StringVar(&config.WSPath, "ws-path", "/mqtt", "Broker endpoint path for ws:// and wss://")
 	
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s -L <broker_url/topic> [--cmd <command> | --config <xml_file>]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  Legacy mode: %s -L mqtt://localhost/host1 --cmd \"ping -c 4 1.1.1.1\"\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  XML mode:    %s -L mqtt://localhost/host1 --config commands.xml\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  Mutual TLS:  %s -L mqtts://broker:8883/host1 --config commands.xml -cafile ca.pem -cert client.pem -key client.key\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nSchemes: mqtt:// or tcp:// (1883), mqtts:// ssl:// or tls:// (8883), ws:// (80), wss:// (443)\n")
 		fmt.Fprintf(os.Stderr, "\nXML mode behavior:\n")
 		fmt.Fprintf(os.Stderr, "  - host1          -> returns status with available commands\n")
 		fmt.Fprintf(os.Stderr, "  - host1/ping     -> executes 'ping' command if defined in XML\n")
@@ -123,20 +139,36 @@ func loadXMLCommands(filename string) (map[string]string, error) {
 	return cmdMap, nil
 }
 
-func parseBrokerURL(brokerURL string) (string, string, error) {
+func parseBrokerURL(brokerURL, wsPath string) (string, string, error) {
 	u, err := url.Parse(brokerURL)
 	if err != nil {
 		return "", "", fmt.Errorf("invalid broker URL: %v", err)
 	}
 	
-	if u.Scheme != "mqtt" && u.Scheme != "tcp" {
-		return "", "", fmt.Errorf("unsupported scheme: %s (use mqtt:// or tcp://)", u.Scheme)
+	// Map the URL scheme to paho's scheme and the usual default port
+	var scheme, defaultPort string
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		scheme, defaultPort = "tcp", "1883"
+	case "mqtts", "ssl", "tls":
+		scheme, defaultPort = "ssl", "8883"
+	case "ws":
+		scheme, defaultPort = "ws", "80"
+	case "wss":
+		scheme, defaultPort = "wss", "443"
+	default:
+		return "", "", fmt.Errorf("unsupported scheme: %s (use mqtt://, mqtts://, ws:// or wss://)", u.Scheme)
 	}
 	
 	// Extract broker address
-	broker := fmt.Sprintf("tcp://%s", u.Host)
+	broker := fmt.Sprintf("%s://%s", scheme, u.Host)
 	if u.Port() == "" {
-		broker = fmt.Sprintf("tcp://%s:1883", u.Hostname())
+		broker = fmt.Sprintf("%s://%s:%s", scheme, u.Hostname(), defaultPort)
+	}
+	
+	// The URL path is the topic, so the WebSocket endpoint comes from -ws-path
+	if scheme == "ws" || scheme == "wss" {
+		broker += "/" + strings.TrimPrefix(wsPath, "/")
 	}
 	
 	// Extract topic from path
@@ -148,6 +180,44 @@ func parseBrokerURL(brokerURL string) (string, string, error) {
 	return broker, topic, nil
 }
 
+// newTLSConfig builds the TLS settings for encrypted broker connections
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.Insecure,
+	}
+	
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("mutual TLS needs both -cert and -key")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	
+	for _, proto := range strings.Split(config.ALPN, ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, proto)
+		}
+	}
+	
+	return tlsConfig, nil
+}
+
 func executeCommand(cmd string) (string, int) {
 	parts := strings.Fields(cmd)
 	if len(parts) == 0 {
@@ -269,7 +339,7 @@ func main() {
 	}
 	
 	// Parse broker URL and extract topic
-	broker, topic, err := parseBrokerURL(config.BrokerURL)
+	broker, topic, err := parseBrokerURL(config.BrokerURL, config.WSPath)
 	if err != nil {
 		log.Fatalf("Error parsing broker URL: %v", err)
 	}
@@ -284,6 +354,15 @@ func main() {
 	// Configure MQTT client options
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(broker)
+	if strings.HasPrefix(broker, "ssl://") || strings.HasPrefix(broker, "wss://") {
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			log.Fatalf("Error configuring TLS: %v", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	} else if config.CAFile != "" || config.CertFile != "" {
+		log.Fatalf("TLS options require an mqtts:// or wss:// broker URL")
+	}
 	opts.SetClientID(config.ClientID)
 	opts.SetCleanSession(true)
 	opts.SetAutoReconnect(true)
@@ -9,39 +9,313 @@ class HomeAutomation {
             load15: []
         };
         this.maxDataPoints = 20;
+        this.lastStatus = {};
+        this.unavailable = {};
+        // ?category=<id> shows one tab and only subscribes to its devices,
+        // for wall tablets that never leave it
+        this.category = new URLSearchParams(window.location.search).get('category');
+        this.pending = {};
+        this.nextRequestId = 1;
+        this.mqttLogFilter = {};
+        this.mqttLogPageSize = 100;
+        this.maxLogEntries = 500;
+        this.publishConsole = { history: [], snippets: [] };
+        this.replyWatchUntil = 0;
         this.init();
     }
 
     init() {
+        this.showCategory();
         this.connectWebSocket();
         this.setupToasts();
         this.setupLoadChart();
         this.startSystemStatsPolling();
         this.loadInitialMqttLog();
+        this.loadCommands();
+        if (document.getElementById('publish-form')) {
+            this.loadPublishConsole();
+        }
+        if (document.getElementById('topic-browser')) {
+            this.loadTopics();
+        }
+    }
+
+    async loadTopics() {
+        try {
+            const response = await fetch('/api/topics');
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            this.topics = await response.json();
+            this.renderTopics();
+        } catch (error) {
+            console.error('Failed to load topics:', error);
+            this.showToast(`Failed to load topics: ${error.message}`, 'danger');
+        }
+    }
+
+    renderTopics() {
+        const container = document.getElementById('topic-tree');
+        if (!container || !this.topics) return;
+
+        const retainedOnly = document.getElementById('topics-retained-only').checked;
+        const canClear = document.getElementById('topic-browser').dataset.canClear === 'true';
+        const children = (this.topics.children || []).filter(child => !retainedOnly || child.retainedTopics > 0);
+
+        container.innerHTML = '';
+        if (children.length === 0) {
+            container.innerHTML = `<div class="text-muted">${retainedOnly ? 'No retained messages' : 'No topics seen yet'}</div>`;
+            return;
+        }
+        children.forEach(child => {
+            container.appendChild(this.renderTopicNode(child, retainedOnly, canClear));
+        });
+    }
+
+    renderTopicNode(node, retainedOnly, canClear) {
+        const children = (node.children || []).filter(child => !retainedOnly || child.retainedTopics > 0);
+        const element = document.createElement(children.length > 0 ? 'details' : 'div');
+        const summary = document.createElement(children.length > 0 ? 'summary' : 'div');
+        summary.className = 'd-flex align-items-center gap-2 py-1';
+        if (children.length === 0) {
+            summary.classList.add('ps-3');
+        }
+
+        summary.innerHTML = `
+            <span class="fw-semibold topic-name"></span>
+            ${node.retained ? '<span class="badge bg-warning text-dark">retained</span>' : ''}
+            ${children.length > 0 ? `<span class="badge bg-secondary">${node.topics} topics</span>` : ''}
+            ${node.retainedTopics > 0 && children.length > 0 ? `<span class="badge bg-warning text-dark">${node.retainedTopics} retained</span>` : ''}
+            <span class="text-muted text-truncate font-monospace topic-payload" style="max-width: 24rem;"></span>
+            <span class="ms-auto d-flex gap-1 topic-actions"></span>
+        `;
+        // Topic names and payloads come from the broker, not markup
+        summary.querySelector('.topic-name').textContent = node.name || '(empty)';
+        if (node.payload !== undefined) {
+            summary.querySelector('.topic-payload').textContent = this.formatPayload(node.payload);
+            summary.title = `${node.topic} · ${node.messages} messages · last ${new Date(node.timestamp).toLocaleString()}`;
+        }
+
+        if (canClear && node.topic) {
+            const actions = summary.querySelector('.topic-actions');
+            if (node.retained) {
+                actions.appendChild(this.clearTopicButton(node.topic, false, 'Clear'));
+            }
+            if (children.length > 0 && node.retainedTopics > 0) {
+                actions.appendChild(this.clearTopicButton(node.topic, true, 'Clear all'));
+            }
+        }
+
+        element.appendChild(summary);
+        if (children.length > 0) {
+            const list = document.createElement('div');
+            list.className = 'ps-3 border-start';
+            children.forEach(child => list.appendChild(this.renderTopicNode(child, retainedOnly, canClear)));
+            element.appendChild(list);
+        }
+        return element;
+    }
+
+    clearTopicButton(topic, subtree, label) {
+        const button = document.createElement('button');
+        button.className = 'btn btn-link btn-sm p-0 text-danger';
+        button.innerHTML = `<i class="bi bi-eraser"></i> ${label}`;
+        button.addEventListener('click', event => {
+            event.preventDefault();
+            clearRetained(topic, subtree);
+        });
+        return button;
+    }
+
+    async loadPublishConsole() {
+        try {
+            const response = await fetch('/api/publish');
+            this.publishConsole = await response.json();
+            this.renderPublishHistory();
+            this.renderSnippets();
+        } catch (error) {
+            console.error('Failed to load publish console:', error);
+        }
+    }
+
+    renderPublishHistory() {
+        const list = document.getElementById('publish-history');
+        if (!list) return;
+
+        const history = this.publishConsole.history || [];
+        if (history.length === 0) {
+            list.innerHTML = '<tr><td colspan="4" class="text-muted">Nothing published yet</td></tr>';
+            return;
+        }
+
+        list.innerHTML = '';
+        history.forEach(record => {
+            const row = document.createElement('tr');
+            row.style.cursor = 'pointer';
+            row.title = 'Click to load into the form';
+            row.innerHTML = `
+                <td>${new Date(record.time).toLocaleTimeString()}</td>
+                <td><code></code></td>
+                <td class="text-truncate font-monospace small" style="max-width: 20rem;"></td>
+                <td>
+                    <span class="badge bg-secondary">QoS ${record.qos}</span>
+                    ${record.retain ? '<span class="badge bg-warning text-dark">retained</span>' : ''}
+                </td>
+            `;
+            // Topics and payloads are user input, not markup
+            row.querySelector('code').textContent = record.topic;
+            row.querySelector('.text-truncate').textContent = record.payload;
+            row.addEventListener('click', () => fillPublishForm(record));
+            list.appendChild(row);
+        });
+    }
+
+    renderSnippets() {
+        const select = document.getElementById('publish-snippets');
+        if (!select) return;
+
+        select.innerHTML = '<option value="">Saved snippets...</option>';
+        (this.publishConsole.snippets || []).forEach(snippet => {
+            const option = document.createElement('option');
+            option.value = snippet.name;
+            option.textContent = snippet.name;
+            select.appendChild(option);
+        });
+    }
+
+    // Shows incoming MQTT log entries for a short while after publishing, so
+    // a device's reply is visible next to the console
+    watchReplies() {
+        const replies = document.getElementById('publish-replies');
+        if (!replies) return;
+        replies.innerHTML = '<div class="text-muted">Waiting for replies...</div>';
+        replies.classList.remove('d-none');
+        this.replyWatchUntil = Date.now() + 10000;
+    }
+
+    showReply(logEntry) {
+        const replies = document.getElementById('publish-replies');
+        if (!replies || logEntry.direction !== 'in' || Date.now() > this.replyWatchUntil) return;
+
+        const placeholder = replies.querySelector('.text-muted');
+        if (placeholder) {
+            placeholder.remove();
+        }
+        const line = document.createElement('div');
+        line.textContent = `${logEntry.topic}: ${this.formatPayload(logEntry.payload)}`;
+        replies.appendChild(line);
+    }
+
+    showCategory() {
+        const tab = this.category && document.getElementById(`${this.category}-tab`);
+        if (tab) {
+            bootstrap.Tab.getOrCreateInstance(tab).show();
+        }
+    }
+
+    // Sends a request over the WebSocket and resolves with the server's reply
+    request(message) {
+        return new Promise((resolve, reject) => {
+            if (!this.ws || this.ws.readyState !== WebSocket.OPEN) {
+                reject(new Error('Not connected'));
+                return;
+            }
+            const id = String(this.nextRequestId++);
+            this.pending[id] = { resolve, reject };
+            this.ws.send(JSON.stringify({ ...message, id }));
+        });
+    }
+
+    handleReply(reply) {
+        const request = this.pending[reply.id];
+        if (!request) return;
+        delete this.pending[reply.id];
+        request.resolve(reply);
+    }
+
+    rejectPending() {
+        Object.values(this.pending).forEach(request => request.reject(new Error('Connection lost')));
+        this.pending = {};
+    }
+
+    async loadCommands() {
+        try {
+            const response = await fetch('/api/commands');
+            this.commands = await response.json();
+            this.renderCommands();
+        } catch (error) {
+            console.error('Failed to load command history:', error);
+        }
     }
 
     async loadInitialMqttLog() {
+        const logContainer = document.getElementById('mqtt-log');
+        if (logContainer) {
+            logContainer.innerHTML = '';
+        }
+        this.oldestLogEntry = null;
+        await this.loadMqttLog();
+    }
+
+    // Loads a page of the MQTT log matching the current filter, continuing
+    // from the oldest entry shown
+    async loadMqttLog() {
+        const params = new URLSearchParams({ limit: this.mqttLogPageSize });
+        Object.entries(this.mqttLogFilter).forEach(([name, value]) => {
+            if (value) params.set(name, value);
+        });
+        if (this.oldestLogEntry) {
+            params.set('before', this.oldestLogEntry.timestamp);
+        }
+
         try {
-            const response = await fetch('/api/mqtt-log');
+            const response = await fetch(`/api/mqtt-log?${params}`);
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
             const logEntries = await response.json();
-            
-            // Clear the placeholder
+
             const logContainer = document.getElementById('mqtt-log');
-            if (logContainer) {
-                logContainer.innerHTML = '';
-                
-                // Add existing log entries (they come in reverse chronological order)
-                logEntries.forEach(entry => {
-                    this.addMqttLogEntry(entry, false); // false = don't scroll to top
-                });
-                
-                if (logEntries.length === 0) {
-                    logContainer.innerHTML = '<div class="text-muted">MQTT messages will appear here...</div>';
-                }
+            if (!logContainer) return;
+
+            // Entries come newest first, so each page goes below the last
+            logEntries.forEach(entry => {
+                this.addMqttLogEntry(entry, false);
+            });
+            if (logEntries.length > 0) {
+                this.oldestLogEntry = logEntries[logEntries.length - 1];
+            }
+
+            const older = document.getElementById('mqtt-log-older');
+            if (older) {
+                older.classList.toggle('d-none', logEntries.length < this.mqttLogPageSize);
+            }
+            if (!logContainer.querySelector('.mqtt-log-entry')) {
+                logContainer.innerHTML = '<div class="text-muted">MQTT messages will appear here...</div>';
             }
         } catch (error) {
-            console.error('Failed to load initial MQTT log:', error);
+            console.error('Failed to load MQTT log:', error);
+            this.showToast(`Failed to load MQTT log: ${error.message}`, 'danger');
+        }
+    }
+
+    setMqttLogFilter(filter) {
+        this.mqttLogFilter = filter;
+        try {
+            this.mqttLogSearch = filter.search ? new RegExp(filter.search) : null;
+        } catch (error) {
+            // The server reports the invalid pattern
+            this.mqttLogSearch = null;
         }
+        this.loadInitialMqttLog();
+    }
+
+    matchesMqttLogFilter(entry) {
+        const filter = this.mqttLogFilter;
+        if (filter.direction && entry.direction !== filter.direction) return false;
+        if (filter.topic && !topicMatches(filter.topic, entry.topic)) return false;
+        if (this.mqttLogSearch && !this.mqttLogSearch.test(entry.payload)) return false;
+        return true;
     }
 
     setupLoadChart() {
@@ -144,24 +418,59 @@ class HomeAutomation {
     }
 
     connectWebSocket() {
-        this.ws = new WebSocket('ws://' + window.location.host + '/ws');
+        const scheme = window.location.protocol === 'https:' ? 'wss://' : 'ws://';
+        this.ws = new WebSocket(scheme + window.location.host + '/ws');
         
         this.ws.onopen = () => {
             this.showToast('Connected to server', 'success');
             document.getElementById('system-status').innerHTML = 
                 '<i class="bi bi-circle-fill text-success"></i> System Online';
+            if (this.category) {
+                // A wall tablet has no use for the MQTT log, so skip it entirely
+                this.request({ type: 'subscribe', categories: [this.category], topics: [] })
+                    .then(() => this.request({ type: 'snapshot' }))
+                    .catch(error => console.error('Failed to subscribe:', error));
+            }
         };
 
         this.ws.onmessage = (event) => {
             const message = JSON.parse(event.data);
-            if (message.type === 'status_update') {
+            if (message.type.endsWith('_result') || message.type === 'error') {
+                this.handleReply(message.data);
+            } else if (message.type === 'status_update') {
                 this.updateDeviceStatus(message.deviceId, message.data);
+                if (message.controls) {
+                    this.updateControlStates(message.deviceId, message.controls);
+                }
+            } else if (message.type === 'availability') {
+                this.updateAvailability(message.deviceId, message.data.available);
             } else if (message.type === 'mqtt_log') {
                 this.addMqttLogEntry(message.data);
+                this.showReply(message.data);
+            } else if (message.type === 'command_result') {
+                this.handleCommandResult(message.data);
+            } else if (message.type === 'scene_activated') {
+                this.showToast(`Scene activated: ${message.data.name || message.data.id}`, 'info');
+            } else if (message.type === 'schedules') {
+                this.updateSchedules(message.data);
+            } else if (message.type === 'config_reloaded') {
+                // Device cards are rendered server-side, so reload to pick up changes
+                this.showToast('Configuration updated, refreshing...', 'info');
+                this.scheduleReload();
+            } else if (message.type === 'devices_discovered') {
+                this.showToast('Discovered devices changed, refreshing...', 'info');
+                this.scheduleReload();
             }
         };
 
         this.ws.onclose = () => {
+            this.rejectPending();
+            // A refused upgrade usually means the session expired
+            fetch('/api/status').then(response => {
+                if (response.status === 401) {
+                    window.location.href = '/login';
+                }
+            }).catch(() => {});
             this.showToast('Connection lost. Reconnecting...', 'warning');
             document.getElementById('system-status').innerHTML = 
                 '<i class="bi bi-circle-fill text-warning"></i> Reconnecting...';
@@ -175,7 +484,24 @@ class HomeAutomation {
         };
     }
 
+    scheduleReload() {
+        // Discovery announcements tend to arrive in bursts; reload once
+        if (this.reloadTimer) return;
+        this.reloadTimer = setTimeout(() => window.location.reload(), 1500);
+    }
+
+    updateAvailability(deviceId, available) {
+        if (available) {
+            delete this.unavailable[deviceId];
+        } else {
+            this.unavailable[deviceId] = true;
+        }
+        this.updateDeviceStatus(deviceId, this.lastStatus[deviceId] || {});
+    }
+
     updateDeviceStatus(deviceId, status) {
+        this.lastStatus[deviceId] = status;
+
         // Update all instances of this device status across all tabs
         const statusElements = document.querySelectorAll(`[id^="status-${deviceId}"]`);
         
@@ -183,7 +509,24 @@ class HomeAutomation {
         let badgeClass = 'bg-success';
         let iconClass = 'bi-circle-fill text-success';
 
-        if (status.value !== undefined) {
+        // Restored from the state file and not yet confirmed by the device
+        if (status.stale) {
+            statusText = 'Last known';
+            badgeClass = 'bg-secondary';
+            iconClass = 'bi-clock-history text-warning';
+        }
+
+        // Reported offline, or silent for longer than its timeout
+        if (this.unavailable[deviceId]) {
+            statusText = 'Offline';
+            badgeClass = 'bg-danger';
+            iconClass = 'bi-circle-fill text-light';
+        }
+
+        const fields = statusElements.length ? statusElements[0].dataset.fields : '';
+        if (fields) {
+            statusText += ' - ' + formatStatusFields(fields, status);
+        } else if (status.value !== undefined) {
             statusText += ' - ' + status.value;
         }
 
@@ -192,10 +535,118 @@ class HomeAutomation {
             statusText += ' (' + time + ')';
         }
 
-        const statusHtml = `<span class="badge ${badgeClass}"><i class="bi ${iconClass}"></i> ${statusText}</span>`;
-        
+        // Status values come from the broker, not markup
         statusElements.forEach(element => {
-            element.innerHTML = statusHtml;
+            const badge = document.createElement('span');
+            badge.className = `badge ${badgeClass}`;
+            const icon = document.createElement('i');
+            icon.className = `bi ${iconClass}`;
+            badge.append(icon, ' ' + statusText);
+            element.replaceChildren(badge);
+        });
+    }
+
+    // Moves sliders and toggles bound to a status field to the device's
+    // reported state, in every tab
+    updateControlStates(deviceId, controls) {
+        Object.entries(controls).forEach(([label, state]) => {
+            const selector = `[data-device="${CSS.escape(deviceId)}"][data-control="${CSS.escape(label)}"]`;
+            document.querySelectorAll(selector).forEach(element => {
+                if (element.tagName === 'BUTTON') {
+                    setToggleState(element, state);
+                } else if (element.type === 'range') {
+                    // Leave a slider alone while it is being dragged
+                    if (element.matches(':active')) return;
+                    element.value = state;
+                    updateSliderValue(deviceId, label, element.value);
+                } else if (element !== document.activeElement) {
+                    // Inputs being edited keep what the user typed
+                    element.value = state;
+                }
+            });
+        });
+    }
+
+    updateSchedules(schedules) {
+        const list = document.getElementById('schedule-list');
+        if (!list) return;
+
+        if (!schedules || schedules.length === 0) {
+            list.innerHTML = '<tr><td colspan="4" class="text-muted">No schedules configured</td></tr>';
+            return;
+        }
+
+        list.innerHTML = '';
+        schedules.forEach(schedule => {
+            const nextFire = schedule.paused ? 'Paused' :
+                (schedule.nextFire ? new Date(schedule.nextFire).toLocaleString() : '--');
+            const row = document.createElement('tr');
+            row.innerHTML = `
+                <td class="schedule-name"></td>
+                <td><code class="schedule-trigger"></code></td>
+                <td class="schedule-next"></td>
+                <td class="text-end">
+                    <button class="btn btn-sm ${schedule.paused ? 'btn-outline-success' : 'btn-outline-warning'}">
+                        <i class="bi ${schedule.paused ? 'bi-play' : 'bi-pause'}"></i>
+                    </button>
+                </td>
+            `;
+            // Schedule names and triggers come from the config, not markup
+            row.querySelector('.schedule-name').textContent = schedule.name || schedule.id;
+            row.querySelector('.schedule-trigger').textContent = schedule.trigger;
+            row.querySelector('.schedule-next').textContent = nextFire;
+            row.querySelector('button').addEventListener('click', () => {
+                setSchedulePaused(schedule.id, !schedule.paused);
+            });
+            list.appendChild(row);
+        });
+    }
+
+    handleCommandResult(result) {
+        if (result.timedOut) {
+            this.showToast(`Command timed out: ${result.command}`, 'danger');
+        } else if (result.exitCode !== 0) {
+            this.showToast(`Command failed (exit ${result.exitCode}): ${result.command}`, 'danger');
+        } else {
+            this.showToast(`Command finished: ${result.command}`, 'success');
+        }
+
+        this.commands = (this.commands || []).filter(c => c.id !== result.id);
+        this.commands.unshift(result);
+        this.renderCommands();
+    }
+
+    renderCommands() {
+        const list = document.getElementById('command-list');
+        if (!list) return;
+
+        if (!this.commands || this.commands.length === 0) {
+            list.innerHTML = '<tr><td colspan="4" class="text-muted">No commands run yet</td></tr>';
+            return;
+        }
+
+        list.innerHTML = '';
+        this.commands.forEach(result => {
+            let badge = '<span class="badge bg-success">OK</span>';
+            if (result.running) {
+                badge = '<span class="badge bg-info">Running</span>';
+            } else if (result.timedOut) {
+                badge = '<span class="badge bg-danger">Timeout</span>';
+            } else if (result.exitCode !== 0) {
+                badge = `<span class="badge bg-danger">Exit ${result.exitCode}</span>`;
+            }
+
+            const row = document.createElement('tr');
+            row.title = (result.stdout || '') + (result.stderr || '');
+            row.innerHTML = `
+                <td>${new Date(result.started).toLocaleTimeString()}</td>
+                <td><code></code></td>
+                <td>${result.running ? '--' : result.durationMs + ' ms'}</td>
+                <td>${badge}</td>
+            `;
+            // Command text and output come from config/processes, not markup
+            row.querySelector('code').textContent = result.command;
+            list.appendChild(row);
         });
     }
 
@@ -223,7 +674,7 @@ class HomeAutomation {
         const toastHtml = `
             <div class="toast ${bgClass} text-white" id="${toastId}" role="alert">
                 <div class="toast-body">
-                    ${message}
+                    <span class="toast-message"></span>
                     <button type="button" class="btn-close btn-close-white float-end" data-bs-dismiss="toast"></button>
                 </div>
             </div>
@@ -232,6 +683,8 @@ class HomeAutomation {
         toastContainer.insertAdjacentHTML('beforeend', toastHtml);
         
         const toastElement = document.getElementById(toastId);
+        // Messages include command lines and names from the config, not markup
+        toastElement.querySelector('.toast-message').textContent = message;
         const toast = new bootstrap.Toast(toastElement, { delay: 3000 });
         toast.show();
 
@@ -244,6 +697,9 @@ class HomeAutomation {
         const logContainer = document.getElementById('mqtt-log');
         if (!logContainer) return;
 
+        // Live entries are shown only if they match the current filter
+        if (scrollToTop && !this.matchesMqttLogFilter(logEntry)) return;
+
         // Remove the placeholder text if it exists
         const placeholder = logContainer.querySelector('.text-muted');
         if (placeholder) {
@@ -253,38 +709,43 @@ class HomeAutomation {
         // Create new log entry
         const logLine = document.createElement('div');
         logLine.className = 'mqtt-log-entry mb-1';
-        
-        // Determine if this is an outgoing message
-        const isOutgoing = logEntry.topic.includes('(OUT)');
+
+        const isOutgoing = logEntry.direction === 'out';
         const topicClass = isOutgoing ? 'text-info' : 'text-warning';
-        const topicText = isOutgoing ? logEntry.topic.replace(' (OUT)', '') : logEntry.topic;
         const direction = isOutgoing ? '→' : '←';
-        
+        const timestamp = new Date(logEntry.timestamp);
+
+        logLine.title = `${timestamp.toISOString()} · QoS ${logEntry.qos} · ${logEntry.size} bytes`;
         logLine.innerHTML = `
-            <span class="text-secondary">[${logEntry.timestamp}]</span>
+            <span class="text-secondary">[${timestamp.toLocaleTimeString()}]</span>
             <span class="text-muted">${direction}</span>
-            <span class="${topicClass}">${topicText}</span>
-            <span class="text-light">: ${this.formatPayload(logEntry.payload)}</span>
+            <span class="${topicClass} mqtt-log-topic"></span>
+            ${logEntry.retain ? '<span class="badge bg-secondary">retained</span>' : ''}
+            <span class="text-light">: <span class="mqtt-log-payload"></span></span>
         `;
+        // Topics and payloads come from the broker, not markup
+        logLine.querySelector('.mqtt-log-topic').textContent = logEntry.topic;
+        logLine.querySelector('.mqtt-log-payload').textContent = this.formatPayload(logEntry.payload);
 
         // Add to top of log for new messages, or to bottom for initial load
         if (scrollToTop) {
             logContainer.insertBefore(logLine, logContainer.firstChild);
-        } else {
-            logContainer.appendChild(logLine);
-        }
 
-        // Keep only the latest entries (limit handled by server, but cleanup any extras)
-        const entries = logContainer.querySelectorAll('.mqtt-log-entry');
-        if (entries.length > 25) {
-            for (let i = 25; i < entries.length; i++) {
+            // Drop the oldest lines once the log gets long
+            const entries = logContainer.querySelectorAll('.mqtt-log-entry');
+            for (let i = this.maxLogEntries; i < entries.length; i++) {
                 entries[i].remove();
             }
-        }
+            if (entries.length > this.maxLogEntries) {
+                this.oldestLogEntry = null;
+                const older = document.getElementById('mqtt-log-older');
+                if (older) older.classList.add('d-none');
+            }
 
-        // Auto-scroll to top to show newest messages (only for new messages)
-        if (scrollToTop) {
+            // Auto-scroll to top to show newest messages
             logContainer.scrollTop = 0;
+        } else {
+            logContainer.appendChild(logLine);
         }
     }
 
@@ -300,46 +761,77 @@ class HomeAutomation {
     }
 }
 
+// Headers for state-changing API requests, including the session's CSRF token
+function jsonHeaders() {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    return {
+        'Content-Type': 'application/json',
+        'X-CSRF-Token': meta ? meta.content : ''
+    };
+}
+
+async function logout() {
+    await fetch('/logout', { method: 'POST', headers: jsonHeaders() });
+    window.location.href = '/login';
+}
+
 // Global functions for button clicks (called from HTML)
-async function sendCommand(deviceId, topic, payload, localCommand) {
-    try {
-        const response = await fetch('/api/control', {
-            method: 'POST',
-            headers: {
-                'Content-Type': 'application/json'
-            },
-            body: JSON.stringify({
-                device: deviceId,
-                topic: topic,
-                payload: payload,
-                localCommand: localCommand
-            })
-        });
+// Formats the mapped status fields listed in a data-fields attribute
+// ("name:unit;name:unit;") for display on a device card.
+function formatStatusFields(fields, status) {
+    return fields.split(';').filter(entry => entry).map(entry => {
+        const separator = entry.indexOf(':');
+        const name = entry.slice(0, separator);
+        const unit = entry.slice(separator + 1);
+        if (status[name] === undefined) return null;
+        return `${name}: ${status[name]}${unit ? ' ' + unit : ''}`;
+    }).filter(text => text).join(', ');
+}
 
-        if (response.ok) {
-            if (topic) {
-                app.showToast(`MQTT command sent to ${topic}`, 'success');
-                console.log(`MQTT command sent - Topic: ${topic}, Payload: ${payload}`);
-            }
-            if (localCommand) {
-                app.showToast(`Local command executed: ${localCommand}`, 'success');
-                console.log(`Local command executed: ${localCommand}`);
+async function sendCommand(deviceId, label, value) {
+    const request = {
+        device: deviceId,
+        label: label,
+        value: value
+    };
+
+    try {
+        if (app.ws && app.ws.readyState === WebSocket.OPEN) {
+            const reply = await app.request({ type: 'control', ...request });
+            if (reply.error) {
+                throw new Error(reply.error);
             }
         } else {
-            throw new Error(`HTTP ${response.status}`);
+            const response = await fetch('/api/control', {
+                method: 'POST',
+                headers: jsonHeaders(),
+                body: JSON.stringify(request)
+            });
+            if (!response.ok) {
+                throw new Error(`HTTP ${response.status}`);
+            }
         }
+
+        app.showToast(`${label} sent`, 'success');
+        console.log(`Control sent - Device: ${deviceId}, Control: ${label}`);
     } catch (error) {
         console.error('Failed to send command:', error);
         app.showToast('Failed to send command', 'danger');
     }
 }
 
-async function sendSliderCommand(deviceId, topic, label, value) {
-    const payload = JSON.stringify({
-        [label.toLowerCase()]: parseInt(value)
-    });
-    
-    await sendCommand(deviceId, topic, payload, '');
+async function sendSliderCommand(deviceId, label, value) {
+    await sendCommand(deviceId, label, parseInt(value));
+}
+
+// Sends a number or text input once the browser accepts it; the server
+// checks the value against the control definition again
+async function sendInputCommand(deviceId, label, input, value) {
+    if (!input.checkValidity()) {
+        input.reportValidity();
+        return;
+    }
+    await sendCommand(deviceId, label, value);
 }
 
 function updateSliderValue(deviceId, label, value, context = '') {
@@ -363,29 +855,255 @@ function updateSliderValue(deviceId, label, value, context = '') {
     }
 }
 
-async function toggleCommand(deviceId, topic, payload, localCommand, button) {
+function setToggleState(button, on) {
+    const label = button.textContent.trim();
+    button.classList.toggle('active', on);
+    button.innerHTML = `<i class="bi ${on ? 'bi-toggle-on' : 'bi-toggle-off'}"></i> ${label}`;
+}
+
+async function toggleCommand(deviceId, label, button) {
     const isActive = button.classList.contains('active');
     
-    // Update all instances of this toggle button across tabs
-    const allToggleButtons = document.querySelectorAll(`[id^="toggle-${deviceId}-${button.id.split('-')[2]}"]`);
+    // Update all instances of this toggle button across tabs; toggles bound
+    // to a status field are corrected once the device reports its state
+    const allToggleButtons = document.querySelectorAll(`[id^="toggle-${deviceId}-${label}-"]`);
     
-    allToggleButtons.forEach(btn => {
-        if (isActive) {
-            btn.classList.remove('active');
-            btn.innerHTML = '<i class="bi bi-toggle-off"></i> ' + btn.textContent.replace(/.*/, btn.textContent.trim());
-        } else {
-            btn.classList.add('active');
-            btn.innerHTML = '<i class="bi bi-toggle-on"></i> ' + btn.textContent.replace(/.*/, btn.textContent.trim());
+    allToggleButtons.forEach(btn => setToggleState(btn, !isActive));
+    
+    // The target state is available to payload templates as .Value
+    await sendCommand(deviceId, label, !isActive);
+}
+
+async function promoteDevice(id) {
+    try {
+        const response = await fetch('/api/discovered/promote', {
+            method: 'POST',
+            headers: jsonHeaders(),
+            body: JSON.stringify({ id: id })
+        });
+
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        app.showToast(`${id} added to config`, 'success');
+    } catch (error) {
+        console.error('Failed to promote device:', error);
+        app.showToast(`Failed to add ${id} to config`, 'danger');
+    }
+}
+
+async function activateScene(id) {
+    try {
+        const response = await fetch('/api/scenes', {
+            method: 'POST',
+            headers: jsonHeaders(),
+            body: JSON.stringify({ id: id })
+        });
+
+        if (!response.ok) {
+            throw new Error(`HTTP ${response.status}`);
+        }
+    } catch (error) {
+        console.error('Failed to activate scene:', error);
+        app.showToast('Failed to activate scene', 'danger');
+    }
+}
+
+async function captureScene() {
+    const name = prompt('Name for the new scene (captures every control that reports its state):');
+    if (!name) return;
+
+    try {
+        const response = await fetch('/api/scenes/capture', {
+            method: 'POST',
+            headers: jsonHeaders(),
+            body: JSON.stringify({ name: name })
+        });
+
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+        const scene = await response.json();
+        app.showToast(`Scene ${scene.ID} saved with ${scene.Actions.length} actions`, 'success');
+    } catch (error) {
+        console.error('Failed to capture scene:', error);
+        app.showToast(`Failed to capture scene: ${error.message}`, 'danger');
+    }
+}
+
+async function setSchedulePaused(id, paused) {
+    try {
+        const response = await fetch('/api/schedules', {
+            method: 'POST',
+            headers: jsonHeaders(),
+            body: JSON.stringify({ id: id, paused: paused })
+        });
+
+        if (!response.ok) {
+            throw new Error(`HTTP ${response.status}`);
+        }
+        app.showToast(`Schedule ${paused ? 'paused' : 'resumed'}`, 'info');
+    } catch (error) {
+        console.error('Failed to update schedule:', error);
+        app.showToast('Failed to update schedule', 'danger');
+    }
+}
+
+function publishForm() {
+    return {
+        topic: document.getElementById('publish-topic').value.trim(),
+        payload: document.getElementById('publish-payload').value,
+        qos: parseInt(document.getElementById('publish-qos').value),
+        retain: document.getElementById('publish-retain').checked
+    };
+}
+
+function fillPublishForm(message) {
+    document.getElementById('publish-topic').value = message.topic;
+    document.getElementById('publish-payload').value = message.payload;
+    document.getElementById('publish-qos').value = String(message.qos);
+    document.getElementById('publish-retain').checked = message.retain;
+}
+
+async function publishMessage(event) {
+    event.preventDefault();
+    const message = publishForm();
+
+    try {
+        const response = await fetch('/api/publish', {
+            method: 'POST',
+            headers: jsonHeaders(),
+            body: JSON.stringify(message)
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+
+        const record = await response.json();
+        const history = (app.publishConsole.history || []).filter(previous =>
+            previous.topic !== record.topic || previous.payload !== record.payload ||
+            previous.qos !== record.qos || previous.retain !== record.retain);
+        app.publishConsole.history = [record, ...history];
+        app.renderPublishHistory();
+        app.watchReplies();
+        app.showToast(`Published to ${record.topic}`, 'success');
+    } catch (error) {
+        console.error('Failed to publish:', error);
+        app.showToast(`Failed to publish: ${error.message}`, 'danger');
+    }
+}
+
+function loadSnippet(name) {
+    const snippet = (app.publishConsole.snippets || []).find(s => s.name === name);
+    if (snippet) {
+        fillPublishForm(snippet);
+    }
+}
+
+async function saveSnippet() {
+    const selected = document.getElementById('publish-snippets').value;
+    const name = prompt('Snippet name', selected);
+    if (!name) return;
+
+    try {
+        const response = await fetch('/api/publish/snippets', {
+            method: 'POST',
+            headers: jsonHeaders(),
+            body: JSON.stringify({ name: name, ...publishForm() })
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+
+        app.publishConsole.snippets = await response.json();
+        app.renderSnippets();
+        document.getElementById('publish-snippets').value = name.trim();
+        app.showToast(`Saved snippet: ${name}`, 'success');
+    } catch (error) {
+        console.error('Failed to save snippet:', error);
+        app.showToast(`Failed to save snippet: ${error.message}`, 'danger');
+    }
+}
+
+async function deleteSnippet() {
+    const name = document.getElementById('publish-snippets').value;
+    if (!name) {
+        app.showToast('Select a snippet to delete', 'warning');
+        return;
+    }
+    if (!confirm(`Delete snippet "${name}"?`)) return;
+
+    try {
+        const response = await fetch(`/api/publish/snippets?name=${encodeURIComponent(name)}`, {
+            method: 'DELETE',
+            headers: jsonHeaders()
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
+        }
+
+        app.publishConsole.snippets = await response.json();
+        app.renderSnippets();
+        app.showToast(`Deleted snippet: ${name}`, 'info');
+    } catch (error) {
+        console.error('Failed to delete snippet:', error);
+        app.showToast(`Failed to delete snippet: ${error.message}`, 'danger');
+    }
+}
+
+async function clearRetained(topic, subtree) {
+    const what = subtree ? `all retained messages under ${topic}` : `the retained message on ${topic}`;
+    if (!confirm(`Clear ${what}?`)) return;
+
+    try {
+        const params = new URLSearchParams({ topic: topic, subtree: subtree });
+        const response = await fetch(`/api/topics?${params}`, {
+            method: 'DELETE',
+            headers: jsonHeaders()
+        });
+        if (!response.ok) {
+            throw new Error(await response.text());
         }
+
+        const result = await response.json();
+        app.showToast(`Cleared ${result.cleared.length} retained messages`, 'success');
+        app.loadTopics();
+    } catch (error) {
+        console.error('Failed to clear retained messages:', error);
+        app.showToast(`Failed to clear retained messages: ${error.message}`, 'danger');
+    }
+}
+
+// topicMatches reports whether topic matches an MQTT subscription filter
+function topicMatches(filter, topic) {
+    const filterLevels = filter.split('/');
+    const topicLevels = topic.split('/');
+    if (topic.startsWith('$') && (filterLevels[0] === '+' || filterLevels[0] === '#')) {
+        return false;
+    }
+    for (let i = 0; i < filterLevels.length; i++) {
+        if (filterLevels[i] === '#') return true;
+        if (i >= topicLevels.length) return false;
+        if (filterLevels[i] !== '+' && filterLevels[i] !== topicLevels[i]) return false;
+    }
+    return filterLevels.length === topicLevels.length;
+}
+
+function filterMqttLog(event) {
+    event.preventDefault();
+    app.setMqttLogFilter({
+        topic: document.getElementById('mqtt-log-topic').value.trim(),
+        search: document.getElementById('mqtt-log-search').value,
+        direction: document.getElementById('mqtt-log-direction').value
     });
-    
-    await sendCommand(deviceId, topic, payload, localCommand);
 }
 
 function clearMqttLog() {
     const logContainer = document.getElementById('mqtt-log');
     if (logContainer) {
         logContainer.innerHTML = '<div class="text-muted">MQTT messages will appear here...</div>';
+        app.oldestLogEntry = null;
+        document.getElementById('mqtt-log-older').classList.add('d-none');
         app.showToast('MQTT log cleared', 'info');
     }
 }